@@ -0,0 +1,151 @@
+package base
+
+import (
+	"sync"
+)
+
+const glsShards = 64
+
+type glsShard struct {
+	sync.RWMutex
+	m map[int]map[interface{}]interface{} // goroutine id => values
+}
+
+// GLS is a goroutine local storage keyed by GoID. Values stay until they are
+// deleted or the goroutine clears them, goroutines started with Go clear
+// theirs on exit.
+type GLS struct {
+	shards [glsShards]glsShard
+}
+
+func NewGLS() *GLS {
+	g := &GLS{}
+	for i := range g.shards {
+		g.shards[i].m = make(map[int]map[interface{}]interface{})
+	}
+	return g
+}
+
+func (g *GLS) shard(gid int) *glsShard {
+	return &g.shards[gid%glsShards]
+}
+
+func (g *GLS) Set(key, val interface{}) {
+	gid := GoID()
+	s := g.shard(gid)
+	s.Lock()
+	vals, ok := s.m[gid]
+	if !ok {
+		vals = make(map[interface{}]interface{})
+		s.m[gid] = vals
+	}
+	vals[key] = val
+	s.Unlock()
+}
+
+func (g *GLS) Get(key interface{}) (val interface{}, ok bool) {
+	gid := GoID()
+	s := g.shard(gid)
+	s.RLock()
+	val, ok = s.m[gid][key]
+	s.RUnlock()
+	return
+}
+
+func (g *GLS) Delete(key interface{}) {
+	gid := GoID()
+	s := g.shard(gid)
+	s.Lock()
+	if vals, ok := s.m[gid]; ok {
+		delete(vals, key)
+		if len(vals) == 0 {
+			delete(s.m, gid)
+		}
+	}
+	s.Unlock()
+}
+
+// Clear drops every value of the current goroutine.
+func (g *GLS) Clear() {
+	gid := GoID()
+	s := g.shard(gid)
+	s.Lock()
+	delete(s.m, gid)
+	s.Unlock()
+}
+
+// Len returns how many goroutines hold values, it helps to spot leaks.
+func (g *GLS) Len() (n int) {
+	for i := range g.shards {
+		g.shards[i].RLock()
+		n += len(g.shards[i].m)
+		g.shards[i].RUnlock()
+	}
+	return
+}
+
+// copy returns the current goroutine's values, only the given keys if any
+func (g *GLS) copy(keys []interface{}) map[interface{}]interface{} {
+	gid := GoID()
+	s := g.shard(gid)
+	s.RLock()
+	defer s.RUnlock()
+
+	vals := s.m[gid]
+	cp := make(map[interface{}]interface{}, len(vals))
+	if keys == nil {
+		for k, v := range vals {
+			cp[k] = v
+		}
+		return cp
+	}
+	for _, k := range keys {
+		if v, ok := vals[k]; ok {
+			cp[k] = v
+		}
+	}
+	return cp
+}
+
+type glsGoOption struct {
+	inherit bool
+	keys    []interface{}
+}
+
+type glsOption func(*glsGoOption)
+
+// WithInherit copies all values of the parent goroutine into the child.
+func WithInherit() glsOption {
+	return func(o *glsGoOption) {
+		o.inherit, o.keys = true, nil
+	}
+}
+
+// WithInheritKeys copies only the given keys of the parent goroutine into the child.
+func WithInheritKeys(keys ...interface{}) glsOption {
+	return func(o *glsGoOption) {
+		o.inherit, o.keys = true, keys
+	}
+}
+
+// Go runs fn in a new goroutine whose values are cleared when fn returns.
+func (g *GLS) Go(fn func(), options ...glsOption) {
+	opt := &glsGoOption{}
+	for _, option := range options {
+		option(opt)
+	}
+
+	var inherited map[interface{}]interface{}
+	if opt.inherit {
+		// copy before starting, the parent may change its values meanwhile
+		inherited = g.copy(opt.keys)
+	}
+
+	go func() {
+		defer g.Clear()
+		for k, v := range inherited {
+			g.Set(k, v)
+		}
+		fn()
+	}()
+}
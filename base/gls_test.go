@@ -0,0 +1,89 @@
+package base
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGLS(t *testing.T) {
+	g := NewGLS()
+	g.Set("rid", "parent")
+	g.Set("span", 1)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		go func(num int) {
+			defer wg.Done()
+			defer g.Clear()
+			if _, ok := g.Get("rid"); ok {
+				t.Errorf("no.%d sees parent value", num)
+			}
+			g.Set("rid", num)
+			if v, ok := g.Get("rid"); !ok || v.(int) != num {
+				t.Errorf("no.%d get:%v", num, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if v, _ := g.Get("rid"); v != "parent" {
+		t.Fatalf("parent rid:%v", v)
+	}
+	g.Delete("span")
+	if _, ok := g.Get("span"); ok {
+		t.Fatalf("span not deleted")
+	}
+	if n := g.Len(); n != 1 {
+		t.Fatalf("goroutines with values:%d", n)
+	}
+	g.Clear()
+	if n := g.Len(); n != 0 {
+		t.Fatalf("goroutines with values after clear:%d", n)
+	}
+}
+
+func TestGLSGo(t *testing.T) {
+	g := NewGLS()
+	g.Set("rid", "r1")
+	g.Set("span", 7)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(3)
+	g.Go(func() {
+		defer wg.Done()
+		if _, ok := g.Get("rid"); ok {
+			t.Errorf("inherited without option")
+		}
+		g.Set("x", 1)
+	})
+	g.Go(func() {
+		defer wg.Done()
+		if v, _ := g.Get("rid"); v != "r1" {
+			t.Errorf("inherit rid:%v", v)
+		}
+		if v, _ := g.Get("span"); v != 7 {
+			t.Errorf("inherit span:%v", v)
+		}
+	}, WithInherit())
+	g.Go(func() {
+		defer wg.Done()
+		if v, _ := g.Get("rid"); v != "r1" {
+			t.Errorf("inherit rid:%v", v)
+		}
+		if _, ok := g.Get("span"); ok {
+			t.Errorf("inherit span not in keys")
+		}
+	}, WithInheritKeys("rid"))
+	wg.Wait()
+
+	g.Clear()
+	// children clear after fn returns, wait for their deferred Clear
+	for i := 0; i < 1000 && g.Len() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := g.Len(); n != 0 {
+		t.Fatalf("goroutines with values:%d", n)
+	}
+}
@@ -5,9 +5,20 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"unsafe"
 )
 
+// GoID returns the current goroutine id. On architectures with a getg stub
+// it is read from the runtime g struct, falling back to parsing runtime.Stack.
 func GoID() int {
+	if goidOffset > 0 {
+		return int(*(*int64)(unsafe.Pointer(uintptr(getg()) + goidOffset)))
+	}
+	return goIDSlow()
+}
+
+func goIDSlow() int {
 	var buf [64]byte
 	n := runtime.Stack(buf[:], false)
 	idField := strings.Fields(strings.TrimPrefix(string(buf[:n]), "goroutine "))[0]
@@ -17,3 +28,58 @@ func GoID() int {
 	}
 	return id
 }
+
+const (
+	goidProbes   = 8
+	goidMaxWords = 48 // scanned words of the g struct, goid sits well within
+)
+
+// offset of goid in the runtime g struct, 0 when unknown
+var goidOffset uintptr
+
+func init() {
+	goidOffset = probeGoIDOffset()
+}
+
+// probeGoIDOffset looks for the word of the g struct that holds the goroutine
+// id reported by runtime.Stack, in several goroutines so that only the real
+// goid field matches them all. The layout of g changes between go versions,
+// so it is discovered rather than hard coded.
+func probeGoIDOffset() uintptr {
+	if getg() == nil {
+		return 0
+	}
+
+	var (
+		wg         sync.WaitGroup
+		candidates [goidProbes][goidMaxWords]bool
+	)
+	wg.Add(goidProbes)
+	for i := 0; i < goidProbes; i++ {
+		go func(i int) {
+			defer wg.Done()
+			g, id := getg(), int64(goIDSlow())
+			for w := 0; w < goidMaxWords; w++ {
+				off := uintptr(w) * unsafe.Sizeof(id)
+				candidates[i][w] = *(*int64)(unsafe.Pointer(uintptr(g) + off)) == id
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	found := uintptr(0)
+	for w := 1; w < goidMaxWords; w++ {
+		match := true
+		for i := 0; i < goidProbes; i++ {
+			match = match && candidates[i][w]
+		}
+		if match {
+			if found != 0 {
+				// ambiguous, stay on the slow path
+				return 0
+			}
+			found = uintptr(w) * unsafe.Sizeof(int64(0))
+		}
+	}
+	return found
+}
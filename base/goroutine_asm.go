@@ -0,0 +1,11 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package base
+
+import (
+	"unsafe"
+)
+
+// getg returns the current goroutine's runtime g struct.
+func getg() unsafe.Pointer
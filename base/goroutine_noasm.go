@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package base
+
+import (
+	"unsafe"
+)
+
+func getg() unsafe.Pointer {
+	return nil
+}
@@ -0,0 +1,42 @@
+package base
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGoID(t *testing.T) {
+	if goidOffset == 0 {
+		t.Logf("goid offset unknown, slow path only")
+	} else {
+		t.Logf("goid offset:%d", goidOffset)
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			defer wg.Done()
+			if fast, slow := GoID(), goIDSlow(); fast != slow {
+				t.Errorf("fast:%d slow:%d", fast, slow)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fast, slow := GoID(), goIDSlow(); fast != slow {
+		t.Fatalf("fast:%d slow:%d", fast, slow)
+	}
+}
+
+func BenchmarkGoID(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		GoID()
+	}
+}
+
+func BenchmarkGoIDSlow(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		goIDSlow()
+	}
+}
@@ -0,0 +1,148 @@
+package base
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+const (
+	DefaultHistogramPrecision = 4
+	MaxHistogramPrecision     = 10
+)
+
+// Histogram counts values in log-linear buckets, the same scheme as HDR
+// histograms: every power of two range is split into 1<<precision buckets,
+// so any value is known within a relative error of 1/(1<<precision).
+type Histogram struct {
+	precision uint8
+	counts    []uint64
+}
+
+func NewHistogram(precision uint8) *Histogram {
+	if precision == 0 || precision > MaxHistogramPrecision {
+		panic("histogram precision must be in [1, 10]")
+	}
+	return &Histogram{
+		precision: precision,
+		counts:    make([]uint64, bucketCount(precision)),
+	}
+}
+
+func bucketCount(precision uint8) int {
+	return (64 - int(precision) + 1) << precision
+}
+
+// bucketIndex maps v to its bucket, values below 1<<precision get their own bucket
+func bucketIndex(v uint64, precision uint8) int {
+	sub := uint64(1) << precision
+	if v < sub {
+		return int(v)
+	}
+	shift := bits.Len64(v) - int(precision) - 1
+	top := v >> uint(shift) // in [sub, 2*sub)
+	return (shift+1)<<precision + int(top-sub)
+}
+
+// bucketRange returns the smallest and largest value of bucket i
+func bucketRange(i int, precision uint8) (lo, hi uint64) {
+	sub := 1 << precision
+	if i < sub {
+		return uint64(i), uint64(i)
+	}
+	shift := i>>precision - 1
+	top := uint64(sub + i&(sub-1))
+	lo = top << uint(shift)
+	return lo, lo + (uint64(1)<<uint(shift) - 1)
+}
+
+// Record is safe for concurrent use.
+func (h *Histogram) Record(v uint64) {
+	atomic.AddUint64(&h.counts[bucketIndex(v, h.precision)], 1)
+}
+
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	s := &HistogramSnapshot{
+		Precision: h.precision,
+		Counts:    make([]uint64, len(h.counts)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return s
+}
+
+// merge adds the counts of o, which must not be recorded to meanwhile
+func (h *Histogram) merge(o *Histogram) {
+	for i, n := range o.counts {
+		if n > 0 {
+			atomic.AddUint64(&h.counts[i], n)
+		}
+	}
+}
+
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+}
+
+// HistogramSnapshot is a copy of a Histogram, snapshots of the same precision
+// can be merged.
+type HistogramSnapshot struct {
+	Precision uint8
+	Counts    []uint64
+}
+
+func (s *HistogramSnapshot) Total() (n uint64) {
+	for _, c := range s.Counts {
+		n += c
+	}
+	return
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile,
+// q in [0, 1], 0 for an empty histogram.
+func (s *HistogramSnapshot) Quantile(q float64) uint64 {
+	total := s.Total()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(total) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	if rank > total {
+		rank = total
+	}
+
+	var seen uint64
+	for i, c := range s.Counts {
+		seen += c
+		if seen >= rank {
+			_, hi := bucketRange(i, s.Precision)
+			return hi
+		}
+	}
+	return 0
+}
+
+// Merge returns a snapshot with the counts of both, nil snapshots are ignored.
+func (s *HistogramSnapshot) Merge(o *HistogramSnapshot) *HistogramSnapshot {
+	if s == nil {
+		return o
+	}
+	if o == nil {
+		return s
+	}
+	if s.Precision != o.Precision {
+		panic("cannot merge histograms of different precision")
+	}
+	m := &HistogramSnapshot{
+		Precision: s.Precision,
+		Counts:    make([]uint64, len(s.Counts)),
+	}
+	for i := range s.Counts {
+		m.Counts[i] = s.Counts[i] + o.Counts[i]
+	}
+	return m
+}
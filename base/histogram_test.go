@@ -0,0 +1,79 @@
+package base
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	for _, precision := range []uint8{1, 4, 10} {
+		values := []uint64{0, 1, 15, 16, 17, 1000, 123456789, math.MaxUint64}
+		for i := 0; i < 1000; i++ {
+			values = append(values, rand.Uint64()>>uint(rand.Intn(64)))
+		}
+		for _, v := range values {
+			i := bucketIndex(v, precision)
+			if i < 0 || i >= bucketCount(precision) {
+				t.Fatalf("precision:%d value:%d index:%d out of range", precision, v, i)
+			}
+			lo, hi := bucketRange(i, precision)
+			if v < lo || v > hi {
+				t.Fatalf("precision:%d value:%d bucket:[%d, %d]", precision, v, lo, hi)
+			}
+			if float64(hi-lo) > float64(lo)/float64(uint64(1)<<precision) {
+				t.Fatalf("precision:%d value:%d bucket:[%d, %d] too wide", precision, v, lo, hi)
+			}
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewHistogram(DefaultHistogramPrecision)
+	values := make([]uint64, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		v := uint64(rand.ExpFloat64() * 1e6)
+		values = append(values, v)
+		h.Record(v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	s := h.Snapshot()
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		exact := values[int(q*float64(len(values)))-1]
+		got := s.Quantile(q)
+		if diff := math.Abs(float64(got)-float64(exact)) / float64(exact); diff > 1.0/(1<<DefaultHistogramPrecision) {
+			t.Fatalf("q:%v exact:%d got:%d", q, exact, got)
+		}
+		t.Logf("q:%v exact:%d got:%d", q, exact, got)
+	}
+}
+
+func TestMetricSnapshotMerge(t *testing.T) {
+	w1, w2, all := NewMetric(), NewMetric(), NewMetric()
+	for i := uint64(1); i <= 1000; i++ {
+		if i%3 == 0 {
+			w1.Add(i)
+		} else {
+			w2.Add(i)
+		}
+		all.Add(i)
+	}
+
+	merged := w1.Snapshot().Merge(w2.Snapshot())
+	expect := all.Snapshot()
+	if merged.Times != expect.Times || merged.Total != expect.Total || merged.Min != expect.Min || merged.Max != expect.Max {
+		t.Fatalf("merged:%+v expect:%+v", merged, expect)
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		if merged.Quantile(q) != expect.Quantile(q) {
+			t.Fatalf("q:%v merged:%d expect:%d", q, merged.Quantile(q), expect.Quantile(q))
+		}
+	}
+
+	empty := NewMetric().Snapshot()
+	if m := empty.Merge(merged); m.Min != merged.Min || m.Times != merged.Times {
+		t.Fatalf("merge into empty:%+v", m)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -40,6 +42,7 @@ Section 7 for discussion of additional workload profiles)`
 type MemFileInfo struct {
 	name       string
 	size       int64
+	modTime    time.Time
 	readOffset int64
 }
 
@@ -56,7 +59,7 @@ func (mfi *MemFileInfo) Mode() fs.FileMode {
 }
 
 func (mfi *MemFileInfo) ModTime() time.Time {
-	return time.Now()
+	return mfi.modTime
 }
 
 func (mfi *MemFileInfo) IsDir() bool {
@@ -67,62 +70,276 @@ func (mfi *MemFileInfo) Sys() interface{} {
 	return nil
 }
 
+// ReadOffset returns the offset the next Read or Write starts at.
 func (mfi *MemFileInfo) ReadOffset() int64 {
 	return mfi.readOffset
 }
 
+// memPatch is a written range of a MemFile
+type memPatch struct {
+	off  int64
+	data []byte
+}
+
+func (p *memPatch) end() int64 {
+	return p.off + int64(len(p.data))
+}
+
+// MemFile is a file of ctt repeated up to its size, so a little memory
+// makes a huge file. Writes are kept as patches over the repeated content
+// and only cost the memory written, bytes past the initial size that were
+// never written read as zeros.
+//
+// MemFile implements io.Reader, io.ReaderAt, io.Writer, io.WriterAt,
+// io.Seeker and io.WriterTo. ReadAt may be called concurrently. Options
+// such as WithReadErrorAt inject faults into reads.
 type MemFile struct {
-	ctt []byte
+	ctt      []byte
+	baseSize int64 // bytes of repeated ctt, the size before any write
+
+	mu      sync.RWMutex
+	patches []memPatch // sorted, neither overlapping nor adjacent
+	closed  bool
 	MemFileInfo
+
+	// faults, see mem_file_fault.go
+	readErrs  []memReadError
+	shortRead int
+	latency   time.Duration
+	corrupts  []int64
 }
 
+var (
+	ErrNegativeOffset = errors.New("offset cannot be negative")
+	ErrInvalidWhence  = errors.New("invalid whence")
+)
+
 func (f *MemFile) Stat() (fs.FileInfo, error) {
-	return &(f.MemFileInfo), nil
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	fi := f.MemFileInfo
+	return &fi, nil
+}
+
+// fill copies the repeated content at off into buf, zeros past baseSize
+func (f *MemFile) fill(buf []byte, off int64) {
+	for len(buf) > 0 {
+		if off >= f.baseSize || len(f.ctt) == 0 {
+			for i := range buf {
+				buf[i] = 0
+			}
+			return
+		}
+		n := copy(buf, f.ctt[off%int64(len(f.ctt)):])
+		if rest := f.baseSize - off; int64(n) > rest {
+			n = int(rest)
+		}
+		buf = buf[n:]
+		off += int64(n)
+	}
+}
+
+// readAt must be called with mu held
+func (f *MemFile) readAt(buf []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if rest := f.size - off; int64(len(buf)) > rest {
+		buf = buf[:rest]
+	}
+	buf, ferr := f.failAt(buf, off)
+	if len(buf) == 0 {
+		return 0, ferr
+	}
+
+	end := off + int64(len(buf))
+	i := sort.Search(len(f.patches), func(i int) bool { return f.patches[i].end() > off })
+	for pos := off; pos < end; {
+		if i < len(f.patches) && f.patches[i].off <= pos {
+			p := &f.patches[i]
+			pos += int64(copy(buf[pos-off:], p.data[pos-p.off:]))
+			i++
+			continue
+		}
+		next := end
+		if i < len(f.patches) && f.patches[i].off < next {
+			next = f.patches[i].off
+		}
+		f.fill(buf[pos-off:next-off], pos)
+		pos = next
+	}
+	f.corrupt(buf, off)
+	return len(buf), ferr
 }
 
 func (f *MemFile) Read(buf []byte) (int, error) {
-	copyOffset := 0
+	f.delay()
+	if f.shortRead > 0 && len(buf) > f.shortRead {
+		buf = buf[:f.shortRead]
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(buf, f.readOffset)
+	f.readOffset += int64(n)
+	return n, err
+}
 
-	for {
-		if f.readOffset >= f.size {
-			if copyOffset > 0 {
-				break
+// ReadAt fails with io.EOF when fewer than len(buf) bytes are left.
+func (f *MemFile) ReadAt(buf []byte, off int64) (int, error) {
+	f.delay()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	n, err := f.readAt(buf, off)
+	if err == nil && n < len(buf) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// writeAt must be called with mu held exclusively, it merges buf with the
+// patches it overlaps or touches, growing the first one in place so
+// sequential writes append
+func (f *MemFile) writeAt(buf []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	end := off + int64(len(buf))
+	i := sort.Search(len(f.patches), func(i int) bool { return f.patches[i].end() >= off })
+	j := i
+	for j < len(f.patches) && f.patches[j].off <= end {
+		j++
+	}
+
+	if i == j {
+		f.patches = append(f.patches, memPatch{})
+		copy(f.patches[i+1:], f.patches[i:])
+		f.patches[i] = memPatch{off: off, data: append([]byte(nil), buf...)}
+	} else {
+		first, last := f.patches[i], f.patches[j-1]
+		start, stop := first.off, last.end()
+		if off < start {
+			start = off
+		}
+		if end > stop {
+			stop = end
+		}
+
+		var data []byte
+		if start == first.off {
+			data = first.data
+			if grow := int(stop-start) - len(data); grow > 0 {
+				data = append(data, make([]byte, grow)...)
 			}
-			return 0, io.EOF
+		} else {
+			data = make([]byte, stop-start)
+			copy(data[first.off-start:], first.data)
 		}
-		readOffset := int(f.readOffset % (int64(len(f.ctt))))
-		copyLen := MinInt(len(buf[copyOffset:]), len(f.ctt[readOffset:]))
-		copyLen = MinInt(copyLen, int(f.size-f.readOffset))
-		if copyLen == 0 {
-			return copyOffset, nil
+		for _, p := range f.patches[i+1 : j] {
+			copy(data[p.off-start:], p.data)
 		}
+		copy(data[off-start:], buf)
 
-		copy(buf[copyOffset:copyOffset+copyLen], f.ctt[readOffset:])
-		copyOffset += copyLen
-		f.readOffset += int64(copyLen)
+		f.patches[i] = memPatch{off: start, data: data}
+		f.patches = append(f.patches[:i+1], f.patches[j:]...)
 	}
 
-	return copyOffset, nil
+	if end > f.size {
+		f.size = end
+	}
+	return len(buf), nil
 }
 
-func (f *MemFile) Close() error {
-	if f.readOffset == -1 {
-		return fs.ErrClosed
-	}
-	f.readOffset = -1
-	return nil
+// Write writes at the offset and grows the file when writing past its end.
+func (f *MemFile) Write(buf []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.writeAt(buf, f.readOffset)
+	f.readOffset += int64(n)
+	return n, err
+}
+
+// WriteAt grows the file when writing past its end, the offset is kept.
+func (f *MemFile) WriteAt(buf []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(buf, off)
 }
 
-func (f *MemFile) Seek(offset int64) error {
+// Seek sets the offset of the next Read or Write, past the end is allowed.
+func (f *MemFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.readOffset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, ErrInvalidWhence
+	}
 	if offset < 0 {
-		return errors.New("offset cannot be negative")
+		return 0, ErrNegativeOffset
 	}
+	f.readOffset = offset
+	return offset, nil
+}
 
-	if f.size <= offset {
-		return io.EOF
+// WriteTo writes the rest of the file to w in chunks, so huge files never
+// sit in memory.
+func (f *MemFile) WriteTo(w io.Writer) (int64, error) {
+	var (
+		buf     = make([]byte, 32<<10)
+		written int64
+	)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			wn, werr := w.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
+			}
+			if wn < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
 	}
+}
 
-	f.size = offset
+func (f *MemFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
 	return nil
 }
 
@@ -134,6 +351,8 @@ func WithContent(ctt []byte) memFileOption {
 	}
 }
 
+// WithFileSize repeats the content up to size, the size defaults to the
+// length of the content.
 func WithFileSize(size int64) memFileOption {
 	return func(f *MemFile) {
 		if size <= 0 {
@@ -149,10 +368,28 @@ func WithDefaultContent() memFileOption {
 	}
 }
 
-func NewMemFile(options ...memFileOption) fs.File {
+func WithFileName(name string) memFileOption {
+	return func(f *MemFile) {
+		f.name = name
+	}
+}
+
+// WithModTime sets the modification time, it defaults to the creation time.
+func WithModTime(modTime time.Time) memFileOption {
+	return func(f *MemFile) {
+		f.modTime = modTime
+	}
+}
+
+func NewMemFile(options ...memFileOption) *MemFile {
 	file := &MemFile{}
+	file.modTime = time.Now()
 	for _, option := range options {
 		option(file)
 	}
+	if file.size == 0 {
+		file.size = int64(len(file.ctt))
+	}
+	file.baseSize = file.size
 	return file
 }
@@ -0,0 +1,93 @@
+package base
+
+import (
+	"time"
+)
+
+// The fault options make a MemFile fail deterministically, to test retry
+// and checksum logic. Faults hit every read, with Read, ReadAt and WriteTo
+// alike unless told otherwise, and are kept by MemFS files across opens.
+
+type memReadError struct {
+	off int64
+	err error
+}
+
+// WithReadErrorAt fails reads reaching offset with err: the bytes before
+// offset are returned along with err, reads from offset on return only err.
+// The earliest of several offsets fails first.
+func WithReadErrorAt(offset int64, err error) memFileOption {
+	return func(f *MemFile) {
+		if offset < 0 {
+			panic("offset cannot be negative")
+		}
+		f.readErrs = append(f.readErrs, memReadError{off: offset, err: err})
+	}
+}
+
+// WithShortReads returns at most maxN bytes per Read, and so per WriteTo
+// chunk. ReadAt is left whole since io.ReaderAt cannot read short without
+// an error.
+func WithShortReads(maxN int) memFileOption {
+	return func(f *MemFile) {
+		if maxN <= 0 {
+			panic("max read size must be positive")
+		}
+		f.shortRead = maxN
+	}
+}
+
+// WithLatency sleeps d in every Read and ReadAt.
+func WithLatency(d time.Duration) memFileOption {
+	return func(f *MemFile) {
+		if d < 0 {
+			panic("latency cannot be negative")
+		}
+		f.latency = d
+	}
+}
+
+// WithCorruptionAt flips every bit of the byte at offset when it is read,
+// whatever was written there, as bad media would.
+func WithCorruptionAt(offset int64) memFileOption {
+	return func(f *MemFile) {
+		if offset < 0 {
+			panic("offset cannot be negative")
+		}
+		f.corrupts = append(f.corrupts, offset)
+	}
+}
+
+func (f *MemFile) delay() {
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+}
+
+// failAt cuts buf, to be read at off, short of the first read error it
+// reaches and returns that error
+func (f *MemFile) failAt(buf []byte, off int64) ([]byte, error) {
+	var fail *memReadError
+	for i := range f.readErrs {
+		re := &f.readErrs[i]
+		if re.off < off+int64(len(buf)) && (fail == nil || re.off < fail.off) {
+			fail = re
+		}
+	}
+	if fail == nil {
+		return buf, nil
+	}
+	if fail.off <= off {
+		return buf[:0], fail.err
+	}
+	return buf[:fail.off-off], fail.err
+}
+
+// corrupt flips the corrupted bytes of buf, read at off
+func (f *MemFile) corrupt(buf []byte, off int64) {
+	for _, c := range f.corrupts {
+		if c >= off && c < off+int64(len(buf)) {
+			buf[c-off] ^= 0xFF
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMemFileReadError(t *testing.T) {
+	fail := errors.New("disk failure")
+	f := NewMemFile(WithContent([]byte("0123456789")), WithFileSize(100),
+		WithReadErrorAt(60, errors.New("later failure")), WithReadErrorAt(25, fail))
+
+	b, err := ioutil.ReadAll(f)
+	if err != fail || len(b) != 25 || string(b[20:]) != "01234" {
+		t.Fatalf("read all:%d, %v", len(b), err)
+	}
+	if n, err := f.Read(make([]byte, 10)); n != 0 || err != fail {
+		t.Fatalf("read at the error:%d, %v", n, err)
+	}
+
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, 20); n != 5 || err != fail {
+		t.Fatalf("read at:%d, %v", n, err)
+	}
+	if n, err := f.ReadAt(buf, 10); n != 10 || err != nil {
+		t.Fatalf("read at before the error:%d, %v", n, err)
+	}
+	f.Seek(0, io.SeekStart)
+	if n, err := f.WriteTo(ioutil.Discard); n != 25 || err != fail {
+		t.Fatalf("write to:%d, %v", n, err)
+	}
+}
+
+func TestMemFileShortReads(t *testing.T) {
+	f := NewMemFile(WithDefaultContent(), WithFileSize(1000), WithShortReads(7))
+	if n, err := f.Read(make([]byte, 100)); n != 7 || err != nil {
+		t.Fatalf("read:%d, %v", n, err)
+	}
+	if n, err := f.ReadAt(make([]byte, 100), 0); n != 100 || err != nil {
+		t.Fatalf("read at:%d, %v", n, err)
+	}
+
+	// io.ReadFull copes with short reads
+	f.Seek(0, io.SeekStart)
+	buf := make([]byte, 1000)
+	if _, err := io.ReadFull(f, buf); err != nil || !bytes.Equal(buf, []byte(Ctt)[:1000]) {
+		t.Fatalf("read full, %v", err)
+	}
+}
+
+func TestMemFileCorruption(t *testing.T) {
+	f := NewMemFile(WithContent([]byte("abcdef")), WithCorruptionAt(2), WithCorruptionAt(5))
+	b, _ := ioutil.ReadAll(f)
+	if expect := []byte{'a', 'b', 'c' ^ 0xFF, 'd', 'e', 'f' ^ 0xFF}; !bytes.Equal(b, expect) {
+		t.Fatalf("read:%q", b)
+	}
+
+	// a write does not repair the byte
+	f.WriteAt([]byte("C"), 2)
+	buf := make([]byte, 2)
+	f.ReadAt(buf, 2)
+	if buf[0] != 'C'^0xFF || buf[1] != 'd' {
+		t.Fatalf("read at:%q", buf)
+	}
+}
+
+func TestMemFileLatency(t *testing.T) {
+	f := NewMemFile(WithContent([]byte("abc")), WithLatency(5*time.Millisecond))
+	begin := time.Now()
+	f.Read(make([]byte, 1))
+	f.ReadAt(make([]byte, 1), 1)
+	if cost := time.Since(begin); cost < 10*time.Millisecond {
+		t.Fatalf("2 reads in %s", cost)
+	}
+}
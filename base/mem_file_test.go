@@ -1,10 +1,15 @@
 package base
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"io"
+	"io/fs"
+	"math/rand"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 // DRY Principle
@@ -47,3 +52,133 @@ func TestMemFile(t *testing.T) {
 		t.Logf("checksum is equal, md5_4:%s md5_:%s, check succ!!", md54Hex, md55Hex)
 	}
 }
+
+// expectContent reads f from the start with every io interface and checks
+// it holds expect
+func expectContent(t *testing.T, f *MemFile, expect []byte) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek, %s", err)
+	}
+	if err := iotest.TestReader(f, expect); err != nil {
+		t.Fatalf("test reader, %s", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek, %s", err)
+	}
+	var b bytes.Buffer
+	if n, err := f.WriteTo(&b); err != nil || n != int64(len(expect)) || !bytes.Equal(b.Bytes(), expect) {
+		t.Fatalf("write to:%d, %v", n, err)
+	}
+}
+
+func TestMemFileSeek(t *testing.T) {
+	ctt := []byte("0123456789")
+	f := NewMemFile(WithContent(ctt), WithFileSize(25))
+	expectContent(t, f, []byte("0123456789012345678901234"))
+
+	for _, c := range []struct {
+		offset int64
+		whence int
+		expect int64
+	}{
+		{3, io.SeekStart, 3},
+		{4, io.SeekCurrent, 7},
+		{-5, io.SeekEnd, 20},
+		{10, io.SeekEnd, 35},
+	} {
+		if pos, err := f.Seek(c.offset, c.whence); err != nil || pos != c.expect {
+			t.Fatalf("seek(%d, %d):%d, %v", c.offset, c.whence, pos, err)
+		}
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read past end:%d, %v", n, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err != ErrNegativeOffset {
+		t.Fatalf("negative seek:%v", err)
+	}
+	if _, err := f.Seek(0, 3); err != ErrInvalidWhence {
+		t.Fatalf("bad whence:%v", err)
+	}
+
+	buf := make([]byte, 4)
+	if n, err := f.ReadAt(buf, 23); n != 2 || err != io.EOF || string(buf[:n]) != "34" {
+		t.Fatalf("read at end:%d, %v", n, err)
+	}
+
+	f.Close()
+	if _, err := f.Read(buf); err != fs.ErrClosed {
+		t.Fatalf("read closed:%v", err)
+	}
+	if err := f.Close(); err != fs.ErrClosed {
+		t.Fatalf("close twice:%v", err)
+	}
+}
+
+func TestMemFileWrite(t *testing.T) {
+	ctt := []byte("abcdefg")
+	f := NewMemFile(WithContent(ctt), WithFileSize(100))
+	expect := make([]byte, 100)
+	for i := range expect {
+		expect[i] = ctt[i%len(ctt)]
+	}
+
+	write := func(off int64, data string) {
+		if n, err := f.WriteAt([]byte(data), off); err != nil || n != len(data) {
+			t.Fatalf("write at %d:%d, %v", off, n, err)
+		}
+		if grow := int(off) + len(data) - len(expect); grow > 0 {
+			expect = append(expect, make([]byte, grow)...)
+		}
+		copy(expect[off:], data)
+		expectContent(t, f, expect)
+	}
+	write(10, "XXXX")
+	write(20, "YY")
+	write(14, "Z")               // touches the first patch
+	write(8, "0123456789ABCDEF") // covers both
+	write(50, "W")
+	write(45, "VVVVV") // touches the next one
+	write(110, "TAIL") // grows with a zero gap
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rnd.Intn(20)+1)
+		rnd.Read(data)
+		write(rnd.Int63n(130), string(data))
+	}
+
+	// Write continues at the offset, sequential writes append to one patch
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("seek, %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		f.Write([]byte("+"))
+		expect = append(expect, '+')
+	}
+	expectContent(t, f, expect)
+	if fi, _ := f.Stat(); fi.Size() != int64(len(expect)) {
+		t.Fatalf("size:%d expect:%d", fi.Size(), len(expect))
+	}
+}
+
+func TestMemFileReadAtConcurrent(t *testing.T) {
+	f := NewMemFile(WithDefaultContent(), WithFileSize(1<<20))
+	f.WriteAt([]byte("patched"), 4096)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 7)
+			for i := 0; i < 100; i++ {
+				if _, err := f.ReadAt(buf, 4096); err != nil || string(buf) != "patched" {
+					t.Errorf("read at:%q, %v", buf, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
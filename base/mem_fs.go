@@ -0,0 +1,265 @@
+package base
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a read only fs.FS of MemFile, so code reading files can be fed
+// huge inputs without disk:
+//
+//	mfs := NewMemFS()
+//	mfs.AddFile("conf/app.yaml", WithContent(conf))
+//	mfs.AddFile("logs/big.log", WithDefaultContent(), WithFileSize(4<<30))
+//
+// Directories are implied by the paths of the files. Every Open returns a
+// new MemFile, so writes to an opened file are not seen by the others.
+type MemFS struct {
+	mu    sync.RWMutex
+	files map[string][]memFileOption
+	dirs  map[string]time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string][]memFileOption),
+		dirs:  map[string]time.Time{".": time.Now()},
+	}
+}
+
+// AddFile adds the file made by the MemFile options at name, a valid
+// fs.FS path, creating its parent directories.
+func (mfs *MemFS) AddFile(name string, options ...memFileOption) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "add", Path: name, Err: fs.ErrInvalid}
+	}
+
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if _, ok := mfs.files[name]; ok {
+		return &fs.PathError{Op: "add", Path: name, Err: fs.ErrExist}
+	}
+	if _, ok := mfs.dirs[name]; ok {
+		return &fs.PathError{Op: "add", Path: name, Err: fs.ErrExist}
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := mfs.files[dir]; ok {
+			return &fs.PathError{Op: "add", Path: name, Err: fs.ErrInvalid}
+		}
+	}
+
+	now := time.Now()
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := mfs.dirs[dir]; !ok {
+			mfs.dirs[dir] = now
+		}
+	}
+	mfs.files[name] = append([]memFileOption{WithModTime(now)}, options...)
+	return nil
+}
+
+// file must be called with mu held
+func (mfs *MemFS) file(name string) (*MemFile, bool) {
+	options, ok := mfs.files[name]
+	if !ok {
+		return nil, false
+	}
+	return NewMemFile(append(options[:len(options):len(options)], WithFileName(path.Base(name)))...), true
+}
+
+// entries must be called with mu held, it returns the sorted entries of dir
+func (mfs *MemFS) entries(dir string) []fs.DirEntry {
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	child := func(name string) bool {
+		return name != "." && strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/")
+	}
+
+	var entries []fs.DirEntry
+	for name := range mfs.files {
+		if child(name) {
+			f, _ := mfs.file(name)
+			entries = append(entries, memDirEntry{&f.MemFileInfo})
+		}
+	}
+	for name, modTime := range mfs.dirs {
+		if child(name) {
+			entries = append(entries, memDirEntry{&memDirInfo{name: path.Base(name), modTime: modTime}})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+func (mfs *MemFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+	if f, ok := mfs.file(name); ok {
+		return f, nil
+	}
+	if modTime, ok := mfs.dirs[name]; ok {
+		return &memDir{
+			path:    name,
+			info:    memDirInfo{name: path.Base(name), modTime: modTime},
+			entries: mfs.entries(name),
+		}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+	if f, ok := mfs.file(name); ok {
+		return &f.MemFileInfo, nil
+	}
+	if modTime, ok := mfs.dirs[name]; ok {
+		return &memDirInfo{name: path.Base(name), modTime: modTime}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+	if _, ok := mfs.dirs[name]; !ok {
+		if _, ok := mfs.files[name]; ok {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return mfs.entries(name), nil
+}
+
+// Glob matches pattern against every file and directory, see path.Match.
+func (mfs *MemFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+
+	var matches []string
+	match := func(name string) {
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	for name := range mfs.files {
+		match(name)
+	}
+	for name := range mfs.dirs {
+		if name != "." {
+			match(name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir  = errors.New("is a directory")
+)
+
+type memDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (di *memDirInfo) Name() string {
+	return di.name
+}
+
+func (di *memDirInfo) Size() int64 {
+	return 0
+}
+
+func (di *memDirInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0555
+}
+
+func (di *memDirInfo) ModTime() time.Time {
+	return di.modTime
+}
+
+func (di *memDirInfo) IsDir() bool {
+	return true
+}
+
+func (di *memDirInfo) Sys() interface{} {
+	return nil
+}
+
+type memDirEntry struct {
+	info fs.FileInfo
+}
+
+func (de memDirEntry) Name() string {
+	return de.info.Name()
+}
+
+func (de memDirEntry) IsDir() bool {
+	return de.info.IsDir()
+}
+
+func (de memDirEntry) Type() fs.FileMode {
+	return de.info.Mode().Type()
+}
+
+func (de memDirEntry) Info() (fs.FileInfo, error) {
+	return de.info, nil
+}
+
+// memDir is an opened directory, its entries are those at open time
+type memDir struct {
+	path    string
+	info    memDirInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) {
+	return &d.info, nil
+}
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errIsDir}
+}
+
+func (d *memDir) Close() error {
+	return nil
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,91 @@
+package base
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestFS(t *testing.T) *MemFS {
+	mfs := NewMemFS()
+	for name, options := range map[string][]memFileOption{
+		"README":              {WithContent([]byte("hello"))},
+		"empty":               nil,
+		"conf/app.yaml":       {WithContent([]byte("port: 80\n"))},
+		"logs/2024/big.log":   {WithDefaultContent(), WithFileSize(1<<20 + 7)},
+		"logs/2024/small.log": {WithContent([]byte("ab")), WithFileSize(9)},
+	} {
+		if err := mfs.AddFile(name, options...); err != nil {
+			t.Fatalf("add %s, %s", name, err)
+		}
+	}
+	return mfs
+}
+
+func TestMemFS(t *testing.T) {
+	mfs := newTestFS(t)
+	if err := fstest.TestFS(mfs, "README", "empty", "conf/app.yaml", "logs/2024/big.log", "logs/2024/small.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(mfs, "logs/2024/small.log")
+	if err != nil || string(b) != "ababababa" {
+		t.Fatalf("read file:%q, %v", b, err)
+	}
+	fi, err := fs.Stat(mfs, "logs/2024/big.log")
+	if err != nil || fi.Size() != 1<<20+7 || fi.Name() != "big.log" {
+		t.Fatalf("stat:%v, %v", fi, err)
+	}
+
+	matches, err := fs.Glob(mfs, "logs/*/*.log")
+	if err != nil || len(matches) != 2 || matches[0] != "logs/2024/big.log" {
+		t.Fatalf("glob:%v, %v", matches, err)
+	}
+	if _, err := fs.Glob(mfs, "["); err == nil {
+		t.Fatalf("bad pattern accepted")
+	}
+
+	entries, err := fs.ReadDir(mfs, ".")
+	if err != nil || len(entries) != 4 || entries[0].Name() != "README" || !entries[1].IsDir() {
+		t.Fatalf("read dir:%v, %v", entries, err)
+	}
+}
+
+func TestMemFSErrors(t *testing.T) {
+	mfs := newTestFS(t)
+	for _, c := range []struct {
+		name string
+		err  error
+	}{
+		{"README", fs.ErrExist},
+		{"conf", fs.ErrExist},
+		{"README/x", fs.ErrInvalid},
+		{"/abs", fs.ErrInvalid},
+		{"a/../b", fs.ErrInvalid},
+	} {
+		if err := mfs.AddFile(c.name); !errors.Is(err, c.err) {
+			t.Fatalf("add %s:%v expect:%v", c.name, err, c.err)
+		}
+	}
+
+	if _, err := mfs.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open missing:%v", err)
+	}
+	if _, err := mfs.ReadDir("README"); err == nil {
+		t.Fatalf("read dir of a file")
+	}
+
+	// opened files are independent
+	f, _ := mfs.Open("README")
+	f.(io.Writer).Write([]byte("HE"))
+	if b, _ := fs.ReadFile(mfs, "README"); string(b) != "hello" {
+		t.Fatalf("write leaked:%s", b)
+	}
+
+	d, _ := mfs.Open("conf")
+	if _, err := d.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read a directory")
+	}
+}
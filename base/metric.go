@@ -1,32 +1,152 @@
 package base
 
 import (
-	"bytes"
 	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
-	"text/template"
 )
 
-const (
-	tpl = `|{{"Metric" | printf "%-20s"}}|{{"Times"|printf "%10s"}}|{{"Avg"|printf "%13s"}}|{{"Min"|printf "%13s"}}|{{"Max"|printf "%13s"}}|
-{{- range $x := . -}}
-{{if (gt (call $x.Times $x) 0)}}
-|{{call $x.Name $x | printf "%-20s" -}}|{{call $x.Times $x | printf "%10d" }}|{{call $x.Avg $x | printf "%10s" }}|{{call $x.Min $x | printf "%10s" }}|{{call $x.Max $x | printf "%10s|"}}
-{{- end}}
-{{- end}}`
-)
+// Label is a key/value tag telling apart metrics of the same name.
+type Label struct {
+	Key   string
+	Value string
+}
 
+// metricKey renders name{k1="v1",k2="v2"} with the labels sorted by key
+func metricKey(name string, labels []Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Key)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Metric records durations in ns, see Counter, Gauge and Meter for the
+// other kinds a MetricContainer holds, and ShardedMetric for a Metric
+// recorded from many goroutines at once.
 type Metric struct {
-	name   string
-	num    uint64
-	elapse uint64
-	min    uint64
-	max    uint64
-	Name   func(*Metric) string
-	Times  func(*Metric) uint64
-	Avg    func(*Metric) string
-	Min    func(*Metric) string
-	Max    func(*Metric) string
+	metricMeta
+	metricCell
+	Name  func(*Metric) string
+	Times func(*Metric) uint64
+	Avg   func(*Metric) string
+	Min   func(*Metric) string
+	Max   func(*Metric) string
+}
+
+// metricCell holds the values of a timing metric twice: adds record to the
+// active values without locking, snapshots swap in the other ones and wait
+// for the adds still on the old ones, which then hold a consistent set.
+type metricCell struct {
+	mu     sync.Mutex // serializes snapshots and resets
+	active uint32     // index of the values adds record to
+	values [2]cellValues
+}
+
+// cellValues are the values recorded between two swaps, the inactive ones
+// are always reset
+type cellValues struct {
+	writers int64  // adds in progress
+	num     uint64 // unused with a histogram, which counts the adds too
+	elapse  uint64
+	min     uint64 // math.MaxUint64 until the first add
+	max     uint64
+	hist    *Histogram // nil when disabled
+}
+
+// MetricSnapshot is a consistent copy of a metric, the fields set depend on
+// Kind: timings have Times, Total, Min, Max and Hist, Min and Max are 0 when
+// Times is 0. Counters and gauges have Value. Meters have the number of
+// marks in Times and their rates per second.
+type MetricSnapshot struct {
+	Name     string
+	Labels   []Label
+	Kind     MetricKind
+	Times    uint64
+	Total    uint64
+	Min      uint64
+	Max      uint64
+	Hist     *HistogramSnapshot // nil when disabled
+	Value    int64
+	Rate1    float64
+	Rate5    float64
+	Rate15   float64
+	RateMean float64
+}
+
+// Key returns the name with its labels, name{k1="v1",k2="v2"}.
+func (s MetricSnapshot) Key() string {
+	return metricKey(s.Name, s.Labels)
+}
+
+// Quantile returns the q quantile from the histogram bounded by Min and
+// Max, 0 without histogram.
+func (s MetricSnapshot) Quantile(q float64) uint64 {
+	if s.Hist == nil || s.Times == 0 {
+		return 0
+	}
+	v := s.Hist.Quantile(q)
+	if v < s.Min {
+		return s.Min
+	}
+	if v > s.Max {
+		return s.Max
+	}
+	return v
+}
+
+// Merge combines the snapshots of the same metric taken on different
+// workers, the name of s is kept.
+func (s MetricSnapshot) Merge(o MetricSnapshot) MetricSnapshot {
+	m := MetricSnapshot{
+		Name:     s.Name,
+		Labels:   s.Labels,
+		Kind:     s.Kind,
+		Times:    s.Times + o.Times,
+		Total:    s.Total + o.Total,
+		Min:      s.Min,
+		Max:      s.Max,
+		Hist:     s.Hist.Merge(o.Hist),
+		Value:    s.Value + o.Value,
+		Rate1:    s.Rate1 + o.Rate1,
+		Rate5:    s.Rate5 + o.Rate5,
+		Rate15:   s.Rate15 + o.Rate15,
+		RateMean: s.RateMean + o.RateMean,
+	}
+	if s.Times == 0 || (o.Times > 0 && o.Min < m.Min) {
+		m.Min = o.Min
+	}
+	if o.Max > m.Max {
+		m.Max = o.Max
+	}
+	return m
+}
+
+func (s MetricSnapshot) Avg() float64 {
+	if s.Times == 0 {
+		return 0
+	}
+	return float64(s.Total) / float64(s.Times)
 }
 
 func SemanticTime(f float64) string {
@@ -46,95 +166,459 @@ func Name(m *Metric) string {
 }
 
 func Times(m *Metric) uint64 {
-	return m.num
+	return m.Snapshot().Times
 }
 
 func Avg(m *Metric) string {
-	return SemanticTime(float64(m.elapse) / float64(m.num))
+	return SemanticTime(m.Snapshot().Avg())
 }
 
 func Min(m *Metric) string {
-	return SemanticTime(float64(m.min))
+	return SemanticTime(float64(m.Snapshot().Min))
 }
 
 func Max(m *Metric) string {
-	return SemanticTime(float64(m.max))
+	return SemanticTime(float64(m.Snapshot().Max))
 }
 
+// NewMetric keeps a histogram of DefaultHistogramPrecision.
 func NewMetric() *Metric {
-	return &Metric{
+	return newMetric(DefaultHistogramPrecision)
+}
+
+// newMetric keeps no histogram when precision is 0
+func newMetric(precision uint8) *Metric {
+	m := &Metric{
 		Name:  Name,
 		Times: Times,
 		Avg:   Avg,
 		Min:   Min,
 		Max:   Max,
 	}
+	m.init(precision)
+	return m
 }
 
+func (m *Metric) kind() MetricKind {
+	return KindTiming
+}
+
+// Add is safe for concurrent use and lock free, min and max are kept with
+// CAS loops.
 func (m *Metric) Add(data uint64) {
-	atomic.AddUint64(&m.num, 1)
-	atomic.AddUint64(&m.elapse, data)
-	if m.min == 0 {
-		m.min = data
-		m.max = data
-	} else if data < m.min {
-		m.min = data
-	} else if data > m.max {
-		m.max = data
-	}
+	m.add(data)
+}
+
+func (m *Metric) Snapshot() MetricSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot(m.metricMeta)
+}
+
+// SnapshotAndReset returns the values recorded since the last reset and
+// starts over, no concurrent Add is lost or counted twice.
+func (m *Metric) SnapshotAndReset() MetricSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshotAndReset(m.metricMeta)
 }
 
 func (m *Metric) Reset() {
-	if m.num == 0 {
+	m.mu.Lock()
+	m.reset()
+	m.mu.Unlock()
+}
+
+// init must be called before c is shared
+func (c *metricCell) init(precision uint8) {
+	for i := range c.values {
+		c.values[i].min = math.MaxUint64
+		if precision > 0 {
+			c.values[i].hist = NewHistogram(precision)
+		}
+	}
+}
+
+// add registers as a writer of the active values and records there, unless
+// a snapshot swapped them in between and may already be reading them
+func (c *metricCell) add(data uint64) {
+	for {
+		i := atomic.LoadUint32(&c.active)
+		v := &c.values[i]
+		atomic.AddInt64(&v.writers, 1)
+		if atomic.LoadUint32(&c.active) == i {
+			v.add(data)
+			atomic.AddInt64(&v.writers, -1)
+			return
+		}
+		atomic.AddInt64(&v.writers, -1)
+	}
+}
+
+// swap must be called with mu held, it activates the other values and
+// returns the old ones once no add records to them anymore
+func (c *metricCell) swap() *cellValues {
+	i := atomic.LoadUint32(&c.active)
+	atomic.StoreUint32(&c.active, 1-i)
+	old := &c.values[i]
+	for atomic.LoadInt64(&old.writers) != 0 {
+		runtime.Gosched()
+	}
+	return old
+}
+
+// snapshot must be called with mu held, the swapped out values are added
+// back to the active ones
+func (c *metricCell) snapshot(meta metricMeta) MetricSnapshot {
+	old := c.swap()
+	s := old.snapshot(meta)
+	c.values[atomic.LoadUint32(&c.active)].merge(old)
+	old.reset()
+	return s
+}
+
+// snapshotAndReset must be called with mu held
+func (c *metricCell) snapshotAndReset(meta metricMeta) MetricSnapshot {
+	old := c.swap()
+	s := old.snapshot(meta)
+	old.reset()
+	return s
+}
+
+// reset must be called with mu held
+func (c *metricCell) reset() {
+	c.swap().reset()
+}
+
+func (v *cellValues) add(data uint64) {
+	if v.hist != nil {
+		v.hist.Record(data)
+	} else {
+		atomic.AddUint64(&v.num, 1)
+	}
+	atomic.AddUint64(&v.elapse, data)
+	v.keepMin(data)
+	v.keepMax(data)
+}
+
+func (v *cellValues) keepMin(data uint64) {
+	for {
+		min := atomic.LoadUint64(&v.min)
+		if data >= min || atomic.CompareAndSwapUint64(&v.min, min, data) {
+			return
+		}
+	}
+}
+
+func (v *cellValues) keepMax(data uint64) {
+	for {
+		max := atomic.LoadUint64(&v.max)
+		if data <= max || atomic.CompareAndSwapUint64(&v.max, max, data) {
+			return
+		}
+	}
+}
+
+// merge adds o, which no add records to, while adds may record to v
+func (v *cellValues) merge(o *cellValues) {
+	if o.min > o.max {
+		// nothing recorded
 		return
 	}
+	if v.hist != nil {
+		v.hist.merge(o.hist)
+	} else {
+		atomic.AddUint64(&v.num, o.num)
+	}
+	atomic.AddUint64(&v.elapse, o.elapse)
+	v.keepMin(o.min)
+	v.keepMax(o.max)
+}
 
-	m.num, m.elapse, m.min, m.max = 0, 0, 0, 0
+// snapshot must be called once no add records to v
+func (v *cellValues) snapshot(meta metricMeta) MetricSnapshot {
+	s := MetricSnapshot{
+		Name:   meta.name,
+		Labels: meta.labels,
+		Times:  v.num,
+		Total:  v.elapse,
+	}
+	if v.hist != nil {
+		s.Hist = v.hist.Snapshot()
+		s.Times = s.Hist.Total()
+	}
+	if s.Times > 0 {
+		s.Min, s.Max = v.min, v.max
+	}
+	return s
 }
 
-// 只支持预先串行分配
+// reset must be called once no add records to v
+func (v *cellValues) reset() {
+	v.num, v.elapse, v.min, v.max = 0, 0, math.MaxUint64, 0
+	if v.hist != nil {
+		v.hist.Reset()
+	}
+}
+
+// metric is a kind of metric a MetricContainer holds
+type metric interface {
+	meta() (name string, labels []Label)
+	kind() MetricKind
+	Snapshot() MetricSnapshot
+	SnapshotAndReset() MetricSnapshot
+	Reset()
+}
+
+// Metrics of every kind share one alias space and can be allocated and
+// removed at any time while others are being recorded. Recording takes no
+// container lock, the metric list is copied on write. Counters, gauges and
+// timings record with atomics only, meters lock once per tick to update
+// their rates. Recording to an alias of another kind panics.
 type MetricContainer struct {
-	title string
-	ms    []*Metric
-	tpl   *template.Template
+	title     string
+	precision uint8
+	shards    int
+	clock     Clock
+
+	mu       sync.Mutex   // serializes allocation and removal
+	ms       atomic.Value // []metric, removed ones are nil so aliases stay stable
+	index    map[string]int
+	failures sync.Map // alias -> alias of its failure metric, see Failures
 }
 
-func NewMetricContainer(title string) (*MetricContainer, error) {
-	tpl, err := template.New(title).Parse(tpl)
-	if err != nil {
-		return nil, err
+type metricContainerOption func(*MetricContainer)
+
+// WithHistogramPrecision sets the precision of the histogram kept by every
+// metric, see Histogram, 0 disables histograms.
+func WithHistogramPrecision(precision uint8) metricContainerOption {
+	return func(mc *MetricContainer) {
+		if precision > MaxHistogramPrecision {
+			panic("histogram precision must be in [0, 10]")
+		}
+		mc.precision = precision
+	}
+}
+
+// WithMetricShards makes the timing metrics ShardedMetric of the given
+// number of shards, 0 means GOMAXPROCS. They are worth their memory for
+// metrics recorded by many goroutines at once.
+func WithMetricShards(shards int) metricContainerOption {
+	return func(mc *MetricContainer) {
+		if shards <= 0 {
+			shards = runtime.GOMAXPROCS(0)
+		}
+		mc.shards = shards
 	}
+}
+
+// WithMetricClock sets the clock meters and stopwatches measure with.
+func WithMetricClock(c Clock) metricContainerOption {
+	return func(mc *MetricContainer) {
+		mc.clock = c
+	}
+}
+
+func NewMetricContainer(title string, options ...metricContainerOption) (*MetricContainer, error) {
+	mc := &MetricContainer{
+		title:     title,
+		precision: DefaultHistogramPrecision,
+		clock:     realClock{},
+		index:     make(map[string]int),
+	}
+	mc.ms.Store(make([]metric, 0, 3))
+	for _, option := range options {
+		option(mc)
+	}
+	return mc, nil
+}
+
+func (mc *MetricContainer) metrics() []metric {
+	return mc.ms.Load().([]metric)
+}
+
+func (mc *MetricContainer) newMetric(kind MetricKind, name string, labels []Label) metric {
+	meta := metricMeta{name: name, labels: labels}
+	switch kind {
+	case KindCounter:
+		return &Counter{metricMeta: meta}
+	case KindGauge:
+		return &Gauge{metricMeta: meta}
+	case KindMeter:
+		m := newMeter(mc.clock)
+		m.metricMeta = meta
+		return m
+	}
+	if mc.shards > 0 {
+		m := newShardedMetric(mc.precision, mc.shards)
+		m.metricMeta = meta
+		return m
+	}
+	m := newMetric(mc.precision)
+	m.metricMeta = meta
+	return m
+}
+
+// alloc must be called with mu held
+func (mc *MetricContainer) alloc(kind MetricKind, name string, labels []Label) int {
+	old := mc.metrics()
+	ms := make([]metric, len(old), len(old)+1)
+	copy(ms, old)
+	ms = append(ms, mc.newMetric(kind, name, labels))
+	mc.ms.Store(ms)
+
+	alias := len(ms) - 1
+	mc.index[metricKey(name, labels)] = alias
+	return alias
+}
+
+func (mc *MetricContainer) getOrAlloc(kind MetricKind, name string, labels []Label) int {
+	key := metricKey(name, labels)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if alias, ok := mc.index[key]; ok {
+		if mc.metrics()[alias].kind() != kind {
+			panic("metric " + key + " is not a " + kind.String())
+		}
+		return alias
+	}
+	return mc.alloc(kind, name, labels)
+}
 
-	return &MetricContainer{
-		title: title,
-		ms:    make([]*Metric, 0, 3),
-		tpl:   tpl,
-	}, nil
+// Alloc always allocates a new timing metric, see GetOrAlloc to share one
+// by name.
+func (mc *MetricContainer) Alloc(name string, labels ...Label) (metricAlias int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.alloc(KindTiming, name, labels)
 }
 
-func (mc *MetricContainer) Alloc(name string) (metricAlias int) {
-	M := NewMetric()
-	M.name = name
-	mc.ms = append(mc.ms, M)
-	return len(mc.ms) - 1
+// GetOrAlloc returns the timing metric of name and labels, allocating it on
+// first use.
+func (mc *MetricContainer) GetOrAlloc(name string, labels ...Label) (metricAlias int) {
+	return mc.getOrAlloc(KindTiming, name, labels)
 }
 
+// GetOrAllocCounter returns the counter of name and labels, allocating it on
+// first use.
+func (mc *MetricContainer) GetOrAllocCounter(name string, labels ...Label) (metricAlias int) {
+	return mc.getOrAlloc(KindCounter, name, labels)
+}
+
+// GetOrAllocGauge returns the gauge of name and labels, allocating it on
+// first use.
+func (mc *MetricContainer) GetOrAllocGauge(name string, labels ...Label) (metricAlias int) {
+	return mc.getOrAlloc(KindGauge, name, labels)
+}
+
+// GetOrAllocMeter returns the meter of name and labels, allocating it on
+// first use.
+func (mc *MetricContainer) GetOrAllocMeter(name string, labels ...Label) (metricAlias int) {
+	return mc.getOrAlloc(KindMeter, name, labels)
+}
+
+// Lookup returns the alias of the metric of name and labels if allocated.
+func (mc *MetricContainer) Lookup(name string, labels ...Label) (metricAlias int, ok bool) {
+	key := metricKey(name, labels)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	metricAlias, ok = mc.index[key]
+	return
+}
+
+// Remove drops the metric, later records to its alias are ignored and the
+// alias is never handed out again.
+func (mc *MetricContainer) Remove(alias int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	old := mc.metrics()
+	if alias < 0 || alias >= len(old) || old[alias] == nil {
+		return
+	}
+	key := metricKey(old[alias].meta())
+	if mc.index[key] == alias {
+		delete(mc.index, key)
+	}
+	ms := make([]metric, len(old))
+	copy(ms, old)
+	ms[alias] = nil
+	mc.ms.Store(ms)
+}
+
+// AddMetric records a duration of data ns to a timing metric.
 func (mc *MetricContainer) AddMetric(alias int, data uint64) {
-	mc.ms[alias].Add(data)
+	if m := mc.metrics()[alias]; m != nil {
+		switch m := m.(type) {
+		case *Metric:
+			m.Add(data)
+		default:
+			m.(*ShardedMetric).Add(data)
+		}
+	}
+}
+
+func (mc *MetricContainer) AddCounter(alias int, n uint64) {
+	if m := mc.metrics()[alias]; m != nil {
+		m.(*Counter).Add(n)
+	}
+}
+
+func (mc *MetricContainer) SetGauge(alias int, v int64) {
+	if m := mc.metrics()[alias]; m != nil {
+		m.(*Gauge).Set(v)
+	}
+}
+
+func (mc *MetricContainer) AddGauge(alias int, delta int64) {
+	if m := mc.metrics()[alias]; m != nil {
+		m.(*Gauge).Add(delta)
+	}
+}
+
+func (mc *MetricContainer) Mark(alias int, n uint64) {
+	if m := mc.metrics()[alias]; m != nil {
+		m.(*Meter).Mark(n)
+	}
 }
 
 func (mc *MetricContainer) Reset() {
-	for i := 0; i < len(mc.ms); i++ {
-		mc.ms[i].Reset()
+	for _, m := range mc.metrics() {
+		if m != nil {
+			m.Reset()
+		}
+	}
+}
+
+// Snapshot returns the metrics in allocation order, removed ones are skipped.
+func (mc *MetricContainer) Snapshot() []MetricSnapshot {
+	ms := mc.metrics()
+	snaps := make([]MetricSnapshot, 0, len(ms))
+	for _, m := range ms {
+		if m != nil {
+			snaps = append(snaps, m.Snapshot())
+		}
+	}
+	return snaps
+}
+
+// SnapshotAndReset snapshots and resets every metric, see Metric.SnapshotAndReset.
+func (mc *MetricContainer) SnapshotAndReset() []MetricSnapshot {
+	ms := mc.metrics()
+	snaps := make([]MetricSnapshot, 0, len(ms))
+	for _, m := range ms {
+		if m != nil {
+			snaps = append(snaps, m.SnapshotAndReset())
+		}
 	}
+	return snaps
 }
 
+// Count renders the metrics as a table, see TableRenderer.
 func (mc *MetricContainer) Count() (string, error) {
-	buffer := bytes.NewBuffer(nil)
-	buffer.WriteString(fmt.Sprintf("\n|%s\n", mc.title))
-	err := mc.tpl.Execute(buffer, mc.ms)
-	if err != nil {
+	var b strings.Builder
+	if err := mc.Render(&b, NewTableRenderer()); err != nil {
 		return "", err
 	}
-	return buffer.String(), nil
+	return b.String(), nil
 }
@@ -0,0 +1,259 @@
+package base
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricKind tells what a metric records and so how it is rendered.
+type MetricKind uint8
+
+const (
+	KindTiming  MetricKind = iota // durations in ns, see Metric
+	KindCounter                   // a count that only goes up, see Counter
+	KindGauge                     // a level that goes up and down, see Gauge
+	KindMeter                     // events per second, see Meter
+)
+
+var kindNames = [...]string{"timing", "counter", "gauge", "meter"}
+
+func (k MetricKind) String() string {
+	return kindNames[k]
+}
+
+type metricMeta struct {
+	name   string
+	labels []Label
+}
+
+func (m *metricMeta) meta() (string, []Label) {
+	return m.name, m.labels
+}
+
+// Counter counts events, SnapshotAndReset starts it over from 0.
+type Counter struct {
+	metricMeta
+	n uint64
+}
+
+func NewCounter() *Counter {
+	return &Counter{}
+}
+
+func (c *Counter) kind() MetricKind {
+	return KindCounter
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+func (c *Counter) snapshot(n uint64) MetricSnapshot {
+	return MetricSnapshot{
+		Name:   c.name,
+		Labels: c.labels,
+		Kind:   KindCounter,
+		Value:  int64(n),
+	}
+}
+
+func (c *Counter) Snapshot() MetricSnapshot {
+	return c.snapshot(c.Value())
+}
+
+func (c *Counter) SnapshotAndReset() MetricSnapshot {
+	return c.snapshot(atomic.SwapUint64(&c.n, 0))
+}
+
+func (c *Counter) Reset() {
+	atomic.StoreUint64(&c.n, 0)
+}
+
+// Gauge holds the last value set, such as a queue depth. It is a level, so
+// SnapshotAndReset keeps it.
+type Gauge struct {
+	metricMeta
+	v int64
+}
+
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+func (g *Gauge) kind() MetricKind {
+	return KindGauge
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.v, delta)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) Snapshot() MetricSnapshot {
+	return MetricSnapshot{
+		Name:   g.name,
+		Labels: g.labels,
+		Kind:   KindGauge,
+		Value:  g.Value(),
+	}
+}
+
+func (g *Gauge) SnapshotAndReset() MetricSnapshot {
+	return g.Snapshot()
+}
+
+func (g *Gauge) Reset() {
+	g.Set(0)
+}
+
+const meterTick = 5 * time.Second
+
+// meterAlphas smooth the 1, 5 and 15 minute rates ticked every meterTick
+var meterAlphas = [3]float64{
+	1 - math.Exp(-meterTick.Minutes()/1),
+	1 - math.Exp(-meterTick.Minutes()/5),
+	1 - math.Exp(-meterTick.Minutes()/15),
+}
+
+// Meter measures the rate of events as exponentially weighted moving
+// averages over 1, 5 and 15 minutes, the way unix load averages are. The
+// averages are ticked every 5 seconds, lazily on Mark and Snapshot, so an
+// idle meter costs nothing.
+type Meter struct {
+	metricMeta
+	clock     Clock
+	count     uint64
+	uncounted uint64 // marks since the last tick
+	nextTick  int64  // unix ns
+
+	mu      sync.Mutex // serializes ticks and resets
+	start   time.Time  // of count
+	rates   [3]float64
+	started bool // rates hold a first tick
+}
+
+func NewMeter() *Meter {
+	return newMeter(realClock{})
+}
+
+func newMeter(clock Clock) *Meter {
+	m := &Meter{clock: clock}
+	m.reset(clock.Now())
+	return m
+}
+
+func (m *Meter) kind() MetricKind {
+	return KindMeter
+}
+
+func (m *Meter) Mark(n uint64) {
+	atomic.AddUint64(&m.count, n)
+	atomic.AddUint64(&m.uncounted, n)
+	m.tick(m.clock.Now())
+}
+
+// tick folds the uncounted marks into the averages once a tick is due, a
+// rate of 0 is folded for every tick missed since
+func (m *Meter) tick(now time.Time) {
+	if now.UnixNano() < atomic.LoadInt64(&m.nextTick) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := atomic.LoadInt64(&m.nextTick)
+	if now.UnixNano() < next {
+		return
+	}
+	ticks := (now.UnixNano()-next)/int64(meterTick) + 1
+	atomic.StoreInt64(&m.nextTick, next+ticks*int64(meterTick))
+
+	instant := float64(atomic.SwapUint64(&m.uncounted, 0)) / meterTick.Seconds()
+	for i, alpha := range meterAlphas {
+		if m.started {
+			m.rates[i] += alpha * (instant - m.rates[i])
+		} else {
+			m.rates[i] = instant
+		}
+		m.rates[i] *= math.Pow(1-alpha, float64(ticks-1))
+	}
+	m.started = true
+}
+
+// Rates returns the 1, 5 and 15 minute rates in events per second.
+func (m *Meter) Rates() (rate1, rate5, rate15 float64) {
+	m.tick(m.clock.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rates[0], m.rates[1], m.rates[2]
+}
+
+// snapshot must be called with mu held
+func (m *Meter) snapshot(now time.Time, count uint64) MetricSnapshot {
+	s := MetricSnapshot{
+		Name:   m.name,
+		Labels: m.labels,
+		Kind:   KindMeter,
+		Times:  count,
+		Rate1:  m.rates[0],
+		Rate5:  m.rates[1],
+		Rate15: m.rates[2],
+	}
+	if elapse := now.Sub(m.start); elapse > 0 {
+		s.RateMean = float64(count) / elapse.Seconds()
+	}
+	return s
+}
+
+// Snapshot has the marks since the last reset in Times and their mean rate.
+func (m *Meter) Snapshot() MetricSnapshot {
+	now := m.clock.Now()
+	m.tick(now)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot(now, atomic.LoadUint64(&m.count))
+}
+
+// SnapshotAndReset starts the count and mean rate over, the moving averages
+// go on.
+func (m *Meter) SnapshotAndReset() MetricSnapshot {
+	now := m.clock.Now()
+	m.tick(now)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.snapshot(now, atomic.SwapUint64(&m.count, 0))
+	m.start = now
+	return s
+}
+
+func (m *Meter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reset(m.clock.Now())
+}
+
+// reset must be called with mu held, or before m is shared
+func (m *Meter) reset(now time.Time) {
+	atomic.StoreUint64(&m.count, 0)
+	atomic.StoreUint64(&m.uncounted, 0)
+	atomic.StoreInt64(&m.nextTick, now.Add(meterTick).UnixNano())
+	m.start = now
+	m.rates = [3]float64{}
+	m.started = false
+}
@@ -0,0 +1,118 @@
+package base
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterGauge(t *testing.T) {
+	c := NewCounter()
+	c.Inc()
+	c.Add(4)
+	if s := c.SnapshotAndReset(); s.Kind != KindCounter || s.Value != 5 || c.Value() != 0 {
+		t.Fatalf("counter:%+v", s)
+	}
+
+	g := NewGauge()
+	g.Set(10)
+	g.Add(-3)
+	if s := g.SnapshotAndReset(); s.Kind != KindGauge || s.Value != 7 || g.Value() != 7 {
+		t.Fatalf("gauge:%+v", s)
+	}
+}
+
+func TestMeter(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	m := newMeter(clock)
+
+	m.Mark(50)
+	clock.Advance(5 * time.Second)
+	rate1, rate5, rate15 := m.Rates()
+	if rate1 != 10 || rate5 != 10 || rate15 != 10 {
+		t.Fatalf("first tick rates:%v %v %v", rate1, rate5, rate15)
+	}
+
+	// a minute idle decays the 1 minute rate to 1/e, the others slower
+	clock.Advance(time.Minute)
+	rate1, rate5, rate15 = m.Rates()
+	if math.Abs(rate1-10/math.E) > 1e-9 || rate5 <= rate1 || rate15 <= rate5 {
+		t.Fatalf("decayed rates:%v %v %v", rate1, rate5, rate15)
+	}
+
+	s := m.SnapshotAndReset()
+	if s.Kind != KindMeter || s.Times != 50 || math.Abs(s.RateMean-50/65.0) > 1e-9 || s.Rate1 != rate1 {
+		t.Fatalf("snapshot:%+v", s)
+	}
+	if s := m.Snapshot(); s.Times != 0 || s.RateMean != 0 || s.Rate1 != rate1 {
+		t.Fatalf("after reset:%+v", s)
+	}
+}
+
+func TestMetricContainerKinds(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	mc, err := NewMetricContainer("kinds", WithMetricClock(clock))
+	if err != nil {
+		t.Fatalf("new metric container, %s", err)
+	}
+	LATENCY := mc.GetOrAlloc("latency")
+	ERRORS := mc.GetOrAllocCounter("errors")
+	DEPTH := mc.GetOrAllocGauge("depth")
+	QPS := mc.GetOrAllocMeter("qps")
+	if mc.GetOrAllocCounter("errors") != ERRORS {
+		t.Fatalf("counter allocated twice")
+	}
+
+	mc.AddMetric(LATENCY, 2000)
+	mc.AddCounter(ERRORS, 3)
+	mc.SetGauge(DEPTH, 8)
+	mc.AddGauge(DEPTH, -2)
+	mc.Mark(QPS, 100)
+	clock.Advance(5 * time.Second)
+
+	snaps := mc.Snapshot()
+	if snaps[ERRORS].Value != 3 || snaps[DEPTH].Value != 6 || snaps[QPS].Rate1 != 20 {
+		t.Fatalf("snapshots:%+v", snaps)
+	}
+
+	ctt, err := mc.Count()
+	if err != nil {
+		t.Fatalf("metric container count, %s", err)
+	}
+	for _, s := range []string{"Value|", "Rate1m|", "         3|", "     20.00/s|"} {
+		if !strings.Contains(ctt, s) {
+			t.Fatalf("missing %q in:%s", s, ctt)
+		}
+	}
+	t.Log(ctt)
+
+	var b strings.Builder
+	if err := mc.WritePrometheus(&b); err != nil {
+		t.Fatalf("write prometheus, %s", err)
+	}
+	for _, line := range []string{
+		"# TYPE errors_total counter\nerrors_total 3\n",
+		"# TYPE depth gauge\ndepth 6\n",
+		"qps_total 100\n",
+		`qps_rate{window="1m"} 20` + "\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("missing %q in:\n%s", line, b.String())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("allocated a counter as a gauge")
+		}
+	}()
+	mc.GetOrAllocGauge("errors")
+}
+
+func BenchmarkMeter(b *testing.B) {
+	m := NewMeter()
+	for i := 0; i < b.N; i++ {
+		m.Mark(1)
+	}
+}
@@ -0,0 +1,227 @@
+package base
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var prometheusQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// prometheusName replaces the characters not allowed in metric names by '_'
+func prometheusName(name string) string {
+	return prometheusSanitize(name, true)
+}
+
+// prometheusLabelName replaces the characters not allowed in label names by
+// '_', unlike metric names they cannot hold ':'
+func prometheusLabelName(name string) string {
+	return prometheusSanitize(name, false)
+}
+
+func prometheusSanitize(name string, colon bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':' && colon:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+var (
+	prometheusEscaper     = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	prometheusHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func prometheusLabels(labels []Label, extra ...Label) string {
+	if len(labels)+len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range append(append([]Label{}, labels...), extra...) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(prometheusLabelName(l.Key))
+		b.WriteString(`="`)
+		b.WriteString(prometheusEscaper.Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func prometheusFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// prometheusFamily returns the name a metric of kind named base is exposed
+// under, timing metrics record ns and are exposed in seconds
+func prometheusFamily(base string, kind MetricKind) string {
+	switch kind {
+	case KindTiming:
+		return base + "_seconds"
+	case KindCounter, KindMeter:
+		return base + "_total"
+	}
+	return base
+}
+
+// prometheusNames returns every name a family of kind writes samples under
+func prometheusNames(family string, kind MetricKind) []string {
+	switch kind {
+	case KindTiming:
+		return []string{family, family + "_sum", family + "_count", family + "_min", family + "_max"}
+	case KindMeter:
+		return []string{family, strings.TrimSuffix(family, "_total") + "_rate"}
+	}
+	return []string{family}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition
+// format. Timing metrics are exposed as summaries in seconds named
+// <name>_seconds with p50/p90/p99/p999 quantiles when they keep a histogram,
+// plus <name>_seconds_min and <name>_seconds_max gauges. Counters are
+// exposed as <name>_total counters and gauges as <name> gauges. Meters are
+// exposed as <name>_total counters of their marks, plus a <name>_rate gauge
+// with a window label of 1m, 5m and 15m. Metrics sharing a name but not
+// labels are written as one family.
+//
+// When metrics would write the same names, as a counter and a meter named x
+// both do x_total, or timings named a.b and a_b both do a_b_seconds, the one
+// allocated first keeps them and the other gets its kind appended to its
+// name: x_meter_total and x_meter_rate, a_b_timing_seconds.
+func (mc *MetricContainer) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	// metrics are told apart by their names before sanitizing
+	type familyKey struct {
+		name string
+		kind MetricKind
+	}
+	var (
+		families []string
+		byName   = make(map[string][]MetricSnapshot)
+		resolved = make(map[familyKey]string)
+		taken    = make(map[string]familyKey) // written names => metrics writing them
+	)
+	free := func(family string, key familyKey) bool {
+		for _, n := range prometheusNames(family, key.kind) {
+			if k, ok := taken[n]; ok && k != key {
+				return false
+			}
+		}
+		return true
+	}
+	for _, s := range mc.Snapshot() {
+		key := familyKey{s.Name, s.Kind}
+		name, ok := resolved[key]
+		if !ok {
+			base := prometheusName(s.Name)
+			name = prometheusFamily(base, s.Kind)
+			for !free(name, key) {
+				base += "_" + s.Kind.String()
+				name = prometheusFamily(base, s.Kind)
+			}
+			for _, n := range prometheusNames(name, s.Kind) {
+				taken[n] = key
+			}
+			resolved[key] = name
+		}
+		if _, ok := byName[name]; !ok {
+			families = append(families, name)
+		}
+		byName[name] = append(byName[name], s)
+	}
+
+	for _, name := range families {
+		snaps := byName[name]
+		bw.WriteString("# HELP " + name + " " + prometheusHelpEscaper.Replace(snaps[0].Name+" of "+mc.title) + "\n")
+		switch snaps[0].Kind {
+		case KindTiming:
+			writePrometheusSummary(bw, name, snaps)
+		case KindCounter:
+			bw.WriteString("# TYPE " + name + " counter\n")
+			for _, s := range snaps {
+				bw.WriteString(name + prometheusLabels(s.Labels) + " " + strconv.FormatInt(s.Value, 10) + "\n")
+			}
+		case KindGauge:
+			bw.WriteString("# TYPE " + name + " gauge\n")
+			for _, s := range snaps {
+				bw.WriteString(name + prometheusLabels(s.Labels) + " " + strconv.FormatInt(s.Value, 10) + "\n")
+			}
+		case KindMeter:
+			writePrometheusMeter(bw, name, snaps)
+		}
+	}
+	return bw.Flush()
+}
+
+func writePrometheusSummary(bw *bufio.Writer, name string, snaps []MetricSnapshot) {
+	bw.WriteString("# TYPE " + name + " summary\n")
+	for _, s := range snaps {
+		if s.Hist != nil {
+			for _, q := range prometheusQuantiles {
+				quantile := Label{Key: "quantile", Value: prometheusFloat(q)}
+				bw.WriteString(name + prometheusLabels(s.Labels, quantile) + " " + prometheusFloat(float64(s.Quantile(q))/1e9) + "\n")
+			}
+		}
+		labels := prometheusLabels(s.Labels)
+		bw.WriteString(name + "_sum" + labels + " " + prometheusFloat(float64(s.Total)/1e9) + "\n")
+		bw.WriteString(name + "_count" + labels + " " + strconv.FormatUint(s.Times, 10) + "\n")
+	}
+
+	for _, suffix := range []string{"_min", "_max"} {
+		bw.WriteString("# TYPE " + name + suffix + " gauge\n")
+		for _, s := range snaps {
+			v := s.Min
+			if suffix == "_max" {
+				v = s.Max
+			}
+			bw.WriteString(name + suffix + prometheusLabels(s.Labels) + " " + prometheusFloat(float64(v)/1e9) + "\n")
+		}
+	}
+}
+
+func writePrometheusMeter(bw *bufio.Writer, name string, snaps []MetricSnapshot) {
+	bw.WriteString("# TYPE " + name + " counter\n")
+	for _, s := range snaps {
+		bw.WriteString(name + prometheusLabels(s.Labels) + " " + strconv.FormatUint(s.Times, 10) + "\n")
+	}
+
+	rate := strings.TrimSuffix(name, "_total") + "_rate"
+	bw.WriteString("# TYPE " + rate + " gauge\n")
+	for _, s := range snaps {
+		for _, r := range []struct {
+			window string
+			v      float64
+		}{{"1m", s.Rate1}, {"5m", s.Rate5}, {"15m", s.Rate15}} {
+			window := Label{Key: "window", Value: r.window}
+			bw.WriteString(rate + prometheusLabels(s.Labels, window) + " " + prometheusFloat(r.v) + "\n")
+		}
+	}
+}
+
+// PrometheusHandler serves the metrics of all containers for scraping, mount
+// it at /metrics. Containers should not use the same metric names.
+func PrometheusHandler(mcs ...*MetricContainer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", PrometheusContentType)
+		for _, mc := range mcs {
+			if err := mc.WritePrometheus(w); err != nil {
+				return
+			}
+		}
+	})
+}
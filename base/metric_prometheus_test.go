@@ -0,0 +1,105 @@
+package base
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheus(t *testing.T) {
+	mc := NewMC(t, "prom")
+	OK := mc.GetOrAlloc("rpc.latency", Label{Key: "service", Value: "user"})
+	FAIL := mc.GetOrAlloc("rpc.latency", Label{Key: "service", Value: `a"b`})
+	mc.AddMetric(OK, 1000000)
+	mc.AddMetric(OK, 3000000)
+	mc.AddMetric(FAIL, 2000000000)
+
+	srv := httptest.NewServer(PrometheusHandler(mc))
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape, %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); ct != PrometheusContentType {
+		t.Fatalf("content type:%s", ct)
+	}
+
+	out := string(body)
+	for _, line := range []string{
+		"# TYPE rpc_latency_seconds summary",
+		`rpc_latency_seconds{service="user",quantile="0.99"} 0.003`,
+		`rpc_latency_seconds_sum{service="user"} 0.004`,
+		`rpc_latency_seconds_count{service="user"} 2`,
+		`rpc_latency_seconds_count{service="a\"b"} 1`,
+		`rpc_latency_seconds_max{service="user"} 0.003`,
+		`rpc_latency_seconds_min{service="a\"b"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out)
+		}
+	}
+	if n := strings.Count(out, "# TYPE rpc_latency_seconds summary"); n != 1 {
+		t.Fatalf("family written %d times", n)
+	}
+	t.Log(out)
+}
+
+func TestPrometheusKindCollision(t *testing.T) {
+	mc := NewMC(t, "collide")
+	mc.AddCounter(mc.GetOrAllocCounter("req"), 3)
+	mc.Mark(mc.GetOrAllocMeter("req", Label{Key: "path", Value: "/"}), 2)
+	mc.SetGauge(mc.GetOrAllocGauge("req_rate"), 7)
+
+	var b strings.Builder
+	if err := mc.WritePrometheus(&b); err != nil {
+		t.Fatalf("write, %s", err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE req_total counter",
+		"req_total 3",
+		"# TYPE req_rate gauge",
+		"req_rate 7",
+		"# TYPE req_meter_total counter",
+		`req_meter_total{path="/"} 2`,
+		"# TYPE req_meter_rate gauge",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out)
+		}
+	}
+	for _, family := range []string{"req_total", "req_rate"} {
+		if n := strings.Count(out, "# TYPE "+family+" "); n != 1 {
+			t.Fatalf("%s typed %d times in:\n%s", family, n, out)
+		}
+	}
+}
+
+func TestPrometheusNameCollision(t *testing.T) {
+	mc := NewMC(t, "sanitize")
+	mc.AddMetric(mc.GetOrAlloc("a.b", Label{Key: "le:x", Value: "1"}), 1e9)
+	mc.AddMetric(mc.GetOrAlloc("a_b", Label{Key: "le:x", Value: "1"}), 2e9)
+
+	var b strings.Builder
+	if err := mc.WritePrometheus(&b); err != nil {
+		t.Fatalf("write, %s", err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		`a_b_seconds_sum{le_x="1"} 1`,
+		`a_b_timing_seconds_sum{le_x="1"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out)
+		}
+	}
+	if n := strings.Count(out, "a_b_seconds_sum{"); n != 1 {
+		t.Fatalf("a_b_seconds_sum written %d times in:\n%s", n, out)
+	}
+	if strings.Contains(out, "le:x") {
+		t.Fatalf("label name not sanitized in:\n%s", out)
+	}
+}
@@ -0,0 +1,388 @@
+package base
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Unit is the time unit metric values are rendered in, metrics record ns.
+type Unit uint8
+
+const (
+	UnitAuto Unit = iota // SemanticTime for text, ns for numbers
+	UnitNs
+	UnitUs
+	UnitMs
+	UnitS
+)
+
+var unitNames = [...]string{"auto", "ns", "us", "ms", "s"}
+var unitDivs = [...]float64{1, 1, 1e3, 1e6, 1e9}
+
+func (u Unit) String() string {
+	return unitNames[u]
+}
+
+// Value converts ns to the unit, UnitAuto keeps ns.
+func (u Unit) Value(ns float64) float64 {
+	return ns / unitDivs[u]
+}
+
+// Format renders ns as text in the unit.
+func (u Unit) Format(ns float64) string {
+	if u == UnitAuto {
+		return SemanticTime(ns)
+	}
+	return fmt.Sprintf("%10.2f %s", u.Value(ns), u)
+}
+
+// Column is a value a renderer shows for every metric.
+type Column string
+
+const (
+	ColumnName  Column = "Metric"
+	ColumnTimes Column = "Times"
+	ColumnTotal Column = "Total"
+	ColumnAvg   Column = "Avg"
+	ColumnMin   Column = "Min"
+	ColumnMax   Column = "Max"
+	ColumnP50   Column = "P50"
+	ColumnP90   Column = "P90"
+	ColumnP99   Column = "P99"
+	ColumnP999  Column = "P999"
+
+	ColumnValue    Column = "Value"
+	ColumnRate1    Column = "Rate1m"
+	ColumnRate5    Column = "Rate5m"
+	ColumnRate15   Column = "Rate15m"
+	ColumnRateMean Column = "RateMean"
+)
+
+// DefaultColumns are those of timing metrics, renderers add ColumnValue and
+// the rate columns when counters, gauges or meters are rendered, unless
+// columns are set with WithColumns.
+var DefaultColumns = []Column{ColumnName, ColumnTimes, ColumnAvg, ColumnMin, ColumnMax, ColumnP50, ColumnP90, ColumnP99, ColumnP999}
+
+var rateColumns = []Column{ColumnRate1, ColumnRate5, ColumnRate15, ColumnRateMean}
+
+// applies reports whether the column has a value for metrics of kind
+func (c Column) applies(kind MetricKind) bool {
+	switch c {
+	case ColumnName:
+		return true
+	case ColumnTimes:
+		return kind == KindTiming || kind == KindMeter
+	case ColumnValue:
+		return kind == KindCounter || kind == KindGauge
+	case ColumnRate1, ColumnRate5, ColumnRate15, ColumnRateMean:
+		return kind == KindMeter
+	}
+	return kind == KindTiming
+}
+
+// rate returns the events per second of a rate column
+func (c Column) rate(s MetricSnapshot) float64 {
+	switch c {
+	case ColumnRate1:
+		return s.Rate1
+	case ColumnRate5:
+		return s.Rate5
+	case ColumnRate15:
+		return s.Rate15
+	}
+	return s.RateMean
+}
+
+// value returns the ns of a time column, ok is false for the others
+func (c Column) value(s MetricSnapshot) (ns float64, ok bool) {
+	switch c {
+	case ColumnTotal:
+		return float64(s.Total), true
+	case ColumnAvg:
+		return s.Avg(), true
+	case ColumnMin:
+		return float64(s.Min), true
+	case ColumnMax:
+		return float64(s.Max), true
+	case ColumnP50:
+		return float64(s.Quantile(0.5)), true
+	case ColumnP90:
+		return float64(s.Quantile(0.9)), true
+	case ColumnP99:
+		return float64(s.Quantile(0.99)), true
+	case ColumnP999:
+		return float64(s.Quantile(0.999)), true
+	}
+	return 0, false
+}
+
+// text renders the column of s for humans, empty when it does not apply
+func (c Column) text(s MetricSnapshot, u Unit) string {
+	if !c.applies(s.Kind) {
+		return ""
+	}
+	switch c {
+	case ColumnName:
+		return s.Key()
+	case ColumnTimes:
+		return strconv.FormatUint(s.Times, 10)
+	case ColumnValue:
+		return strconv.FormatInt(s.Value, 10)
+	case ColumnRate1, ColumnRate5, ColumnRate15, ColumnRateMean:
+		return fmt.Sprintf("%10.2f/s", c.rate(s))
+	}
+	ns, _ := c.value(s)
+	return u.Format(ns)
+}
+
+// number renders the column of s for machines, times in u
+func (c Column) number(s MetricSnapshot, u Unit) string {
+	switch c {
+	case ColumnName, ColumnTimes, ColumnValue:
+		return c.text(s, u)
+	case ColumnRate1, ColumnRate5, ColumnRate15, ColumnRateMean:
+		return strconv.FormatFloat(c.rate(s), 'f', -1, 64)
+	}
+	ns, _ := c.value(s)
+	return strconv.FormatFloat(u.Value(ns), 'f', -1, 64)
+}
+
+// Renderer writes metric snapshots in some format, timing metrics without
+// any record are left out by the built-in renderers.
+type Renderer interface {
+	Render(w io.Writer, title string, snaps []MetricSnapshot) error
+}
+
+type renderConfig struct {
+	unit    Unit
+	columns []Column
+}
+
+type renderOption func(*renderConfig)
+
+func WithUnit(u Unit) renderOption {
+	return func(c *renderConfig) {
+		c.unit = u
+	}
+}
+
+func WithColumns(columns ...Column) renderOption {
+	return func(c *renderConfig) {
+		c.columns = columns
+	}
+}
+
+func newRenderConfig(options []renderOption) renderConfig {
+	c := renderConfig{unit: UnitAuto}
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// columnsFor returns the columns set, or those fitting the kinds of snaps
+func (c renderConfig) columnsFor(snaps []MetricSnapshot) []Column {
+	if c.columns != nil {
+		return c.columns
+	}
+	var values, rates bool
+	for _, s := range snaps {
+		values = values || ColumnValue.applies(s.Kind)
+		rates = rates || ColumnRate1.applies(s.Kind)
+	}
+	columns := DefaultColumns
+	if values {
+		columns = append(columns[:len(columns):len(columns)], ColumnValue)
+	}
+	if rates {
+		columns = append(columns[:len(columns):len(columns)], rateColumns...)
+	}
+	return columns
+}
+
+func recorded(snaps []MetricSnapshot) []MetricSnapshot {
+	rs := make([]MetricSnapshot, 0, len(snaps))
+	for _, s := range snaps {
+		if s.Kind != KindTiming || s.Times > 0 {
+			rs = append(rs, s)
+		}
+	}
+	return rs
+}
+
+// TableRenderer is the fixed width table of MetricContainer.Count.
+type TableRenderer struct {
+	renderConfig
+}
+
+func NewTableRenderer(options ...renderOption) *TableRenderer {
+	return &TableRenderer{newRenderConfig(options)}
+}
+
+func (r *TableRenderer) cell(c Column, v string) string {
+	switch c {
+	case ColumnName:
+		return fmt.Sprintf("%-20s", v)
+	case ColumnTimes:
+		return fmt.Sprintf("%10s", v)
+	}
+	return fmt.Sprintf("%13s", v)
+}
+
+func (r *TableRenderer) Render(w io.Writer, title string, snaps []MetricSnapshot) error {
+	snaps = recorded(snaps)
+	columns := r.columnsFor(snaps)
+	var b strings.Builder
+	b.WriteString("\n|" + title + "\n|")
+	for _, c := range columns {
+		b.WriteString(r.cell(c, string(c)) + "|")
+	}
+	for _, s := range snaps {
+		b.WriteString("\n|")
+		for _, c := range columns {
+			b.WriteString(r.cell(c, c.text(s, r.unit)) + "|")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// MarkdownRenderer writes a markdown table headed by the title.
+type MarkdownRenderer struct {
+	renderConfig
+}
+
+func NewMarkdownRenderer(options ...renderOption) *MarkdownRenderer {
+	return &MarkdownRenderer{newRenderConfig(options)}
+}
+
+func (r *MarkdownRenderer) Render(w io.Writer, title string, snaps []MetricSnapshot) error {
+	snaps = recorded(snaps)
+	columns := r.columnsFor(snaps)
+	var b strings.Builder
+	b.WriteString("### " + title + "\n\n|")
+	for _, c := range columns {
+		b.WriteString(" " + string(c) + " |")
+	}
+	b.WriteString("\n|")
+	for _, c := range columns {
+		if c == ColumnName {
+			b.WriteString(" --- |")
+		} else {
+			b.WriteString(" ---: |")
+		}
+	}
+	for _, s := range snaps {
+		b.WriteString("\n|")
+		for _, c := range columns {
+			v := strings.TrimSpace(c.text(s, r.unit))
+			b.WriteString(" " + strings.Replace(v, "|", `\|`, -1) + " |")
+		}
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// CSVRenderer writes a header row and a row per metric, times are numbers
+// in the unit, ns for UnitAuto, and rates are per second.
+type CSVRenderer struct {
+	renderConfig
+}
+
+func NewCSVRenderer(options ...renderOption) *CSVRenderer {
+	return &CSVRenderer{newRenderConfig(options)}
+}
+
+func (r *CSVRenderer) Render(w io.Writer, title string, snaps []MetricSnapshot) error {
+	snaps = recorded(snaps)
+	columns := r.columnsFor(snaps)
+	cw := csv.NewWriter(w)
+	header := make([]string, 0, len(columns))
+	for _, c := range columns {
+		header = append(header, string(c))
+	}
+	cw.Write(header)
+
+	for _, s := range snaps {
+		row := make([]string, 0, len(columns))
+		for _, c := range columns {
+			if c.applies(s.Kind) {
+				row = append(row, c.number(s, r.unit))
+			} else {
+				row = append(row, "")
+			}
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// JSONRenderer writes {"title":..,"unit":..,"metrics":[{..}]}, a metric has
+// its name, labels, kind and the columns applying to its kind keyed by lower
+// case column name, times are numbers in the unit, ns for UnitAuto, and
+// rates are per second.
+type JSONRenderer struct {
+	renderConfig
+}
+
+func NewJSONRenderer(options ...renderOption) *JSONRenderer {
+	return &JSONRenderer{newRenderConfig(options)}
+}
+
+func (r *JSONRenderer) Render(w io.Writer, title string, snaps []MetricSnapshot) error {
+	unit := r.unit
+	if unit == UnitAuto {
+		unit = UnitNs
+	}
+
+	snaps = recorded(snaps)
+	columns := r.columnsFor(snaps)
+	metrics := make([]map[string]interface{}, 0, len(snaps))
+	for _, s := range snaps {
+		m := make(map[string]interface{}, len(columns)+2)
+		m["kind"] = s.Kind.String()
+		for _, c := range columns {
+			if !c.applies(s.Kind) {
+				continue
+			}
+			switch c {
+			case ColumnName:
+				m["name"] = s.Name
+				if len(s.Labels) > 0 {
+					labels := make(map[string]string, len(s.Labels))
+					for _, l := range s.Labels {
+						labels[l.Key] = l.Value
+					}
+					m["labels"] = labels
+				}
+			case ColumnTimes:
+				m["times"] = s.Times
+			case ColumnValue:
+				m["value"] = s.Value
+			case ColumnRate1, ColumnRate5, ColumnRate15, ColumnRateMean:
+				m[strings.ToLower(string(c))] = c.rate(s)
+			default:
+				ns, _ := c.value(s)
+				m[strings.ToLower(string(c))] = unit.Value(ns)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"title":   title,
+		"unit":    unit.String(),
+		"metrics": metrics,
+	})
+}
+
+// Render writes the metrics through r.
+func (mc *MetricContainer) Render(w io.Writer, r Renderer) error {
+	return r.Render(w, mc.title, mc.Snapshot())
+}
@@ -0,0 +1,99 @@
+package base
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func renderMC(t *testing.T) *MetricContainer {
+	mc := NewMC(t, "render")
+	GET := mc.Alloc("get", Label{Key: "db", Value: "user"})
+	mc.Alloc("idle")
+	mc.AddMetric(GET, 1000)
+	mc.AddMetric(GET, 3000)
+	return mc
+}
+
+func TestRenderTable(t *testing.T) {
+	mc := renderMC(t)
+	var b strings.Builder
+	if err := mc.Render(&b, NewTableRenderer(WithUnit(UnitUs), WithColumns(ColumnName, ColumnTimes, ColumnAvg))); err != nil {
+		t.Fatalf("render, %s", err)
+	}
+	expect := "\n|render\n" +
+		"|Metric              |     Times|          Avg|\n" +
+		`|get{db="user"}      |         2|      2.00 us|`
+	if b.String() != expect {
+		t.Fatalf("table:\n%s\nexpect:\n%s", b.String(), expect)
+	}
+
+	ctt, err := mc.Count()
+	if err != nil {
+		t.Fatalf("count, %s", err)
+	}
+	if !strings.HasPrefix(ctt, "\n|render\n|Metric              |     Times|          Avg|") || strings.Contains(ctt, "idle") {
+		t.Fatalf("count:%s", ctt)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	mc := renderMC(t)
+	var b strings.Builder
+	if err := mc.Render(&b, NewMarkdownRenderer(WithUnit(UnitMs), WithColumns(ColumnName, ColumnMax))); err != nil {
+		t.Fatalf("render, %s", err)
+	}
+	expect := "### render\n\n| Metric | Max |\n| --- | ---: |\n| get{db=\"user\"} | 0.00 ms |\n"
+	if b.String() != expect {
+		t.Fatalf("markdown:\n%s\nexpect:\n%s", b.String(), expect)
+	}
+}
+
+func TestRenderCSV(t *testing.T) {
+	mc := renderMC(t)
+	var b strings.Builder
+	if err := mc.Render(&b, NewCSVRenderer(WithUnit(UnitUs), WithColumns(ColumnName, ColumnTimes, ColumnTotal, ColumnMin))); err != nil {
+		t.Fatalf("render, %s", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv, %s", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("rows:%v", rows)
+	}
+	if got := strings.Join(rows[1], ","); got != `get{db="user"},2,4,1` {
+		t.Fatalf("row:%s", got)
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	mc := renderMC(t)
+	var b strings.Builder
+	if err := mc.Render(&b, NewJSONRenderer()); err != nil {
+		t.Fatalf("render, %s", err)
+	}
+	var out struct {
+		Title   string
+		Unit    string
+		Metrics []struct {
+			Name   string
+			Labels map[string]string
+			Times  uint64
+			Avg    float64
+			Max    float64
+			P50    float64
+		}
+	}
+	if err := json.Unmarshal([]byte(b.String()), &out); err != nil {
+		t.Fatalf("unmarshal, %s", err)
+	}
+	if out.Title != "render" || out.Unit != "ns" || len(out.Metrics) != 1 {
+		t.Fatalf("json:%s", b.String())
+	}
+	m := out.Metrics[0]
+	if m.Name != "get" || m.Labels["db"] != "user" || m.Times != 2 || m.Avg != 2000 || m.Max != 3000 || m.P50 < 1000 {
+		t.Fatalf("metric:%+v", m)
+	}
+}
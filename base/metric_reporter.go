@@ -0,0 +1,147 @@
+package base
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report is what a MetricContainer recorded in [Start, End).
+type Report struct {
+	Title   string
+	Start   time.Time
+	End     time.Time
+	Metrics []MetricSnapshot
+}
+
+// ReportSink receives the reports of a Reporter.
+type ReportSink interface {
+	Report(r Report) error
+}
+
+type ReportSinkFunc func(r Report) error
+
+func (f ReportSinkFunc) Report(r Report) error {
+	return f(r)
+}
+
+// InfoLogger is satisfied by *log.LogAdaptor.
+type InfoLogger interface {
+	Infof(format string, v ...interface{})
+}
+
+// LogSink renders reports with r and logs them at info level.
+func LogSink(l InfoLogger, r Renderer) ReportSink {
+	return ReportSinkFunc(func(rp Report) error {
+		var b strings.Builder
+		if err := r.Render(&b, rp.Title, rp.Metrics); err != nil {
+			return err
+		}
+		l.Infof("%s", b.String())
+		return nil
+	})
+}
+
+// WriterSink renders reports with r to w.
+func WriterSink(w io.Writer, r Renderer) ReportSink {
+	return ReportSinkFunc(func(rp Report) error {
+		return r.Render(w, rp.Title, rp.Metrics)
+	})
+}
+
+// Reporter hands the metrics of a MetricContainer to a sink every interval
+// and resets them, so each report covers exactly one window: a record lands
+// in the report of the window it was added in, see Metric.SnapshotAndReset.
+type Reporter struct {
+	mc       *MetricContainer
+	interval time.Duration
+	sink     ReportSink
+	clock    Clock
+	onError  func(error)
+
+	start time.Time
+	once  sync.Once
+	stop  chan struct{}
+	done  chan struct{}
+	err   error
+}
+
+type reporterOption func(*Reporter)
+
+// WithReportClock sets the clock windows are measured and waited with.
+func WithReportClock(c Clock) reporterOption {
+	return func(r *Reporter) {
+		r.clock = c
+	}
+}
+
+// WithReportErrorHandler is called with the errors of the periodic reports,
+// they are dropped by default.
+func WithReportErrorHandler(onError func(error)) reporterOption {
+	return func(r *Reporter) {
+		r.onError = onError
+	}
+}
+
+// NewReporter resets mc and starts reporting every interval.
+func NewReporter(mc *MetricContainer, interval time.Duration, sink ReportSink, options ...reporterOption) *Reporter {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	r := &Reporter{
+		mc:       mc,
+		interval: interval,
+		sink:     sink,
+		clock:    realClock{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, option := range options {
+		option(r)
+	}
+	mc.Reset()
+	r.start = r.clock.Now()
+	go r.loop()
+	return r
+}
+
+func (r *Reporter) loop() {
+	defer close(r.done)
+	for {
+		timer := r.clock.NewTimer(r.start.Add(r.interval).Sub(r.clock.Now()))
+		select {
+		case <-timer.C():
+			if err := r.report(); err != nil && r.onError != nil {
+				r.onError(err)
+			}
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (r *Reporter) report() error {
+	metrics := r.mc.SnapshotAndReset()
+	end := r.clock.Now()
+	rp := Report{
+		Title:   r.mc.title,
+		Start:   r.start,
+		End:     end,
+		Metrics: metrics,
+	}
+	r.start = end
+	return r.sink.Report(rp)
+}
+
+// Stop ends reporting and hands the last, partial window to the sink,
+// returning its error. Later calls only return the same error.
+func (r *Reporter) Stop() error {
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+		r.err = r.report()
+	})
+	return r.err
+}
@@ -0,0 +1,92 @@
+package base
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Infof(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func TestReporter(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	mc := NewMC(t, "report")
+	REQ := mc.Alloc("req")
+	mc.AddMetric(REQ, 999) // before the reporter, dropped
+
+	reports := make(chan Report, 10)
+	r := NewReporter(mc, time.Second, ReportSinkFunc(func(rp Report) error {
+		reports <- rp
+		return nil
+	}), WithReportClock(clock))
+
+	mc.AddMetric(REQ, 100)
+	mc.AddMetric(REQ, 300)
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Second)
+
+	var rp Report
+	select {
+	case rp = <-reports:
+	case <-time.After(time.Second):
+		t.Fatalf("no report")
+	}
+	if rp.Title != "report" || !rp.Start.Equal(time.Unix(0, 0)) || !rp.End.Equal(time.Unix(1, 0)) {
+		t.Fatalf("report:%+v", rp)
+	}
+	if s := rp.Metrics[REQ]; s.Times != 2 || s.Total != 400 {
+		t.Fatalf("first window:%+v", s)
+	}
+
+	waitTimers(t, clock, 1)
+	mc.AddMetric(REQ, 50)
+	clock.Advance(500 * time.Millisecond)
+	if err := r.Stop(); err != nil {
+		t.Fatalf("stop, %s", err)
+	}
+	rp = <-reports
+	if s := rp.Metrics[REQ]; s.Times != 1 || s.Total != 50 || !rp.End.Equal(time.Unix(1, 5e8)) {
+		t.Fatalf("final window:%+v", rp)
+	}
+	if err := r.Stop(); err != nil || len(reports) != 0 {
+		t.Fatalf("stopped twice")
+	}
+}
+
+func TestReporterLogSink(t *testing.T) {
+	mc := NewMC(t, "log")
+	REQ := mc.Alloc("req")
+	l := &recordLogger{}
+	r := NewReporter(mc, time.Millisecond, LogSink(l, NewTableRenderer()))
+	mc.AddMetric(REQ, 100)
+	time.Sleep(20 * time.Millisecond)
+	if err := r.Stop(); err != nil {
+		t.Fatalf("stop, %s", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var recorded int
+	for _, line := range l.lines {
+		if !strings.HasPrefix(line, "\n|log\n") {
+			t.Fatalf("line:%s", line)
+		}
+		if strings.Contains(line, "req") {
+			recorded++
+		}
+	}
+	if recorded != 1 {
+		t.Fatalf("req reported %d times in %d reports", recorded, len(l.lines))
+	}
+}
@@ -0,0 +1,117 @@
+package base
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+const cacheLineSize = 64
+
+// metricShard keeps its cell off the cache lines of its neighbours, the
+// padding is a whole line so adjacent line prefetching does not pull them in
+// either
+type metricShard struct {
+	metricCell
+	_ [cacheLineSize - unsafe.Sizeof(metricCell{})%cacheLineSize + cacheLineSize]byte
+}
+
+// ShardedMetric is a Metric whose values are spread over cache line padded
+// shards picked by goroutine id, not by cpu: a goroutine always records to
+// the same shard, so goroutines spread evenly over the ids contend less on
+// one cache line than with Metric. Reads merge the shards and so cost a
+// little more.
+//
+// Without the fast GoID (see goroutine_noasm.go) the goroutine id costs more
+// than the contention it would save, ShardedMetric then keeps one shard.
+type ShardedMetric struct {
+	metricMeta
+	shards []metricShard
+	mask   uint64
+}
+
+// NewShardedMetric keeps a histogram of DefaultHistogramPrecision in every
+// shard, shards is rounded up to a power of two, 0 means GOMAXPROCS.
+// It is 1 when the goroutine id is only known from runtime.Stack.
+func NewShardedMetric(shards int) *ShardedMetric {
+	return newShardedMetric(DefaultHistogramPrecision, shards)
+}
+
+func newShardedMetric(precision uint8, shards int) *ShardedMetric {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	if goidOffset == 0 {
+		shards = 1
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	m := &ShardedMetric{
+		shards: make([]metricShard, n),
+		mask:   uint64(n - 1),
+	}
+	for i := range m.shards {
+		m.shards[i].init(precision)
+	}
+	return m
+}
+
+func (m *ShardedMetric) kind() MetricKind {
+	return KindTiming
+}
+
+// Add is safe for concurrent use.
+func (m *ShardedMetric) Add(data uint64) {
+	if m.mask == 0 {
+		m.shards[0].add(data)
+		return
+	}
+	m.shards[uint64(GoID())&m.mask].add(data)
+}
+
+func (m *ShardedMetric) lock() {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+	}
+}
+
+func (m *ShardedMetric) unlock() {
+	for i := range m.shards {
+		m.shards[i].mu.Unlock()
+	}
+}
+
+// snapshot must be called with the shards locked, it merges the snapshots
+// of the shards taken by take
+func (m *ShardedMetric) snapshot(take func(c *metricCell, meta metricMeta) MetricSnapshot) MetricSnapshot {
+	s := take(&m.shards[0].metricCell, m.metricMeta)
+	for i := 1; i < len(m.shards); i++ {
+		s = s.Merge(take(&m.shards[i].metricCell, m.metricMeta))
+	}
+	return s
+}
+
+// Snapshot merges the snapshots of the shards, every one is as consistent
+// as Metric.Snapshot.
+func (m *ShardedMetric) Snapshot() MetricSnapshot {
+	m.lock()
+	defer m.unlock()
+	return m.snapshot((*metricCell).snapshot)
+}
+
+// SnapshotAndReset returns the values recorded since the last reset and
+// starts over, no concurrent Add is lost or counted twice.
+func (m *ShardedMetric) SnapshotAndReset() MetricSnapshot {
+	m.lock()
+	defer m.unlock()
+	return m.snapshot((*metricCell).snapshotAndReset)
+}
+
+func (m *ShardedMetric) Reset() {
+	m.lock()
+	defer m.unlock()
+	for i := range m.shards {
+		m.shards[i].reset()
+	}
+}
@@ -0,0 +1,87 @@
+package base
+
+import (
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestShardedMetric(t *testing.T) {
+	if size := unsafe.Sizeof(metricShard{}); size%cacheLineSize != 0 || size < 2*cacheLineSize {
+		t.Fatalf("shard size:%d", size)
+	}
+
+	m := NewShardedMetric(3)
+	expect := 4
+	if goidOffset == 0 {
+		expect = 1
+	}
+	if len(m.shards) != expect {
+		t.Fatalf("shards:%d", len(m.shards))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= 1000; i++ {
+				m.Add(uint64(g*1000 + i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	s := m.SnapshotAndReset()
+	if s.Times != 8000 || s.Total != 8000*8001/2 || s.Min != 1 || s.Max != 8000 {
+		t.Fatalf("snapshot:%+v", s)
+	}
+	if q := s.Quantile(0.5); q < 3800 || q > 4200 {
+		t.Fatalf("p50:%d", q)
+	}
+	if s := m.Snapshot(); s.Times != 0 || s.Hist.Total() != 0 {
+		t.Fatalf("after reset:%+v", s)
+	}
+}
+
+func TestMetricContainerShards(t *testing.T) {
+	mc, err := NewMetricContainer("sharded", WithMetricShards(0))
+	if err != nil {
+		t.Fatalf("new metric container, %s", err)
+	}
+	SHARDED := mc.Alloc("sharded")
+	mc.Measure(SHARDED, func() {})
+	mc.AddMetric(SHARDED, 100)
+	if s := mc.Snapshot()[SHARDED]; s.Times != 2 || s.Max < 100 {
+		t.Fatalf("snapshot:%+v", s)
+	}
+}
+
+type adder interface {
+	Add(data uint64)
+}
+
+func benchParallel(b *testing.B, m adder) {
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint64
+		for pb.Next() {
+			i++
+			m.Add(i)
+		}
+	})
+}
+
+func BenchmarkMetricParallel(b *testing.B) {
+	b.Run("metric", func(b *testing.B) {
+		benchParallel(b, NewMetric())
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchParallel(b, NewShardedMetric(0))
+	})
+	b.Run("metric-nohist", func(b *testing.B) {
+		benchParallel(b, newMetric(0))
+	})
+	b.Run("sharded-nohist", func(b *testing.B) {
+		benchParallel(b, newShardedMetric(0, 0))
+	})
+}
@@ -1,6 +1,9 @@
 package base
 
 import (
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -38,6 +41,44 @@ func TestMetric(t *testing.T) {
 	t.Log(ctt)
 }
 
+func TestMetricSnapshotWhileAdding(t *testing.T) {
+	m := NewMetric()
+	var (
+		wg   sync.WaitGroup
+		stop int32
+	)
+	wg.Add(1)
+	// snapshots swap the values out and back in, every one must be whole
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&stop) == 0 {
+			s := m.Snapshot()
+			if s.Total != 7*s.Times || s.Hist.Total() != s.Times {
+				t.Errorf("torn snapshot:%+v", s)
+				return
+			}
+		}
+	}()
+
+	var adders sync.WaitGroup
+	adders.Add(8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer adders.Done()
+			for j := 0; j < 10000; j++ {
+				m.Add(7)
+			}
+		}()
+	}
+	adders.Wait()
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if s := m.Snapshot(); s.Times != 80000 || s.Total != 560000 || s.Min != 7 || s.Max != 7 {
+		t.Fatalf("snapshot:%+v", s)
+	}
+}
+
 func BenchmarkMetric(b *testing.B) {
 	mc := NewMC(b, "test")
 	BENCH := mc.Alloc("bench")
@@ -47,3 +88,144 @@ func BenchmarkMetric(b *testing.B) {
 		mc.AddMetric(BENCH, i)
 	}
 }
+
+func TestMetricConcurrent(t *testing.T) {
+	mc := NewMC(t, "concurrent")
+	CONC := mc.Alloc("concurrent")
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		snaps []MetricSnapshot
+		stop  = make(chan struct{})
+		done  = make(chan struct{})
+	)
+	// reset windows while recording, nothing may be lost or counted twice
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := mc.SnapshotAndReset()[CONC]
+			mu.Lock()
+			snaps = append(snaps, s)
+			mu.Unlock()
+			if _, err := mc.Count(); err != nil {
+				t.Errorf("metric container count, %s", err)
+			}
+		}
+	}()
+
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		go func(no uint64) {
+			defer wg.Done()
+			for j := uint64(0); j < 1000; j++ {
+				mc.AddMetric(CONC, no*1000+j)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+	snaps = append(snaps, mc.SnapshotAndReset()[CONC])
+
+	var (
+		times, total uint64
+		min          uint64 = math.MaxUint64
+		max          uint64
+	)
+	for _, s := range snaps {
+		if s.Times == 0 {
+			continue
+		}
+		times += s.Times
+		total += s.Total
+		if s.Min < min {
+			min = s.Min
+		}
+		if s.Max > max {
+			max = s.Max
+		}
+	}
+	if times != 100000 || total != 100000*99999/2 || min != 0 || max != 99999 {
+		t.Fatalf("times:%d total:%d min:%d max:%d", times, total, min, max)
+	}
+	t.Logf("windows:%d", len(snaps))
+}
+
+func TestMetricZero(t *testing.T) {
+	m := NewMetric()
+	m.Add(5)
+	m.Add(0)
+	m.Add(3)
+	if s := m.Snapshot(); s.Min != 0 || s.Max != 5 || s.Times != 3 {
+		t.Fatalf("snapshot:%+v", s)
+	}
+	m.Reset()
+	m.Add(7)
+	if s := m.Snapshot(); s.Min != 7 || s.Max != 7 || s.Times != 1 {
+		t.Fatalf("snapshot:%+v", s)
+	}
+}
+
+func TestMetricContainerDynamic(t *testing.T) {
+	mc := NewMC(t, "dynamic")
+	services := []string{"user", "order", "pay", "stock"}
+
+	var wg sync.WaitGroup
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		go func(no int) {
+			defer wg.Done()
+			service := services[no%len(services)]
+			for j := 0; j < 100; j++ {
+				alias := mc.GetOrAlloc("rpc", Label{Key: "service", Value: service}, Label{Key: "code", Value: "ok"})
+				mc.AddMetric(alias, uint64(j))
+			}
+			// allocation and removal while others record
+			tmp := mc.Alloc("tmp")
+			mc.AddMetric(tmp, 1)
+			mc.Remove(tmp)
+			mc.AddMetric(tmp, 1)
+		}(i)
+	}
+	wg.Wait()
+
+	snaps := mc.Snapshot()
+	if len(snaps) != len(services) {
+		t.Fatalf("snapshots:%d", len(snaps))
+	}
+	for _, s := range snaps {
+		if s.Times != 2500 {
+			t.Fatalf("%s times:%d", s.Key(), s.Times)
+		}
+	}
+
+	// labels are matched regardless of order
+	a1 := mc.GetOrAlloc("rpc", Label{Key: "code", Value: "ok"}, Label{Key: "service", Value: "user"})
+	a2, ok := mc.Lookup("rpc", Label{Key: "service", Value: "user"}, Label{Key: "code", Value: "ok"})
+	if !ok || a1 != a2 {
+		t.Fatalf("alias:%d lookup:%d %v", a1, a2, ok)
+	}
+	if key := metricKey("rpc", []Label{{Key: "service", Value: "user"}, {Key: "code", Value: "ok"}}); key != `rpc{code="ok",service="user"}` {
+		t.Fatalf("key:%s", key)
+	}
+
+	mc.Remove(a1)
+	if _, ok := mc.Lookup("rpc", Label{Key: "service", Value: "user"}, Label{Key: "code", Value: "ok"}); ok {
+		t.Fatalf("lookup removed metric")
+	}
+	if len(mc.Snapshot()) != len(services)-1 {
+		t.Fatalf("snapshots after remove:%d", len(mc.Snapshot()))
+	}
+
+	ctt, err := mc.Count()
+	if err != nil {
+		t.Errorf("metric container count, %s", err)
+	}
+	t.Log(ctt)
+}
@@ -0,0 +1,104 @@
+package base
+
+import (
+	"time"
+)
+
+// Stopwatch times one run into a timing metric, see MetricContainer.Start.
+type Stopwatch struct {
+	mc    *MetricContainer
+	alias int
+	begin time.Time
+}
+
+// Start returns a running stopwatch for the timing metric of alias:
+//
+//	defer mc.Start(RPC).Stop()
+func (mc *MetricContainer) Start(alias int) Stopwatch {
+	return Stopwatch{
+		mc:    mc,
+		alias: alias,
+		begin: mc.clock.Now(),
+	}
+}
+
+func (sw Stopwatch) elapse() time.Duration {
+	d := sw.mc.clock.Now().Sub(sw.begin)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Stop records the time since Start and returns it, a stopwatch is meant to
+// be stopped once.
+func (sw Stopwatch) Stop() time.Duration {
+	d := sw.elapse()
+	sw.mc.AddMetric(sw.alias, uint64(d))
+	return d
+}
+
+// StopErr records the time since Start into the failure metric when err is
+// not nil, see MetricContainer.Failures.
+func (sw Stopwatch) StopErr(err error) time.Duration {
+	if err == nil {
+		return sw.Stop()
+	}
+	d := sw.elapse()
+	sw.mc.AddMetric(sw.mc.Failures(sw.alias), uint64(d))
+	return d
+}
+
+// Track starts timing the metric of alias until the returned func is
+// called, for use with defer:
+//
+//	defer mc.Track(RPC)()
+func (mc *MetricContainer) Track(alias int) func() {
+	sw := mc.Start(alias)
+	return func() {
+		sw.Stop()
+	}
+}
+
+// TrackErr is Track recording into the failure metric when *errp is not nil
+// once the returned func is called, errp is meant to be a named result:
+//
+//	func call() (err error) {
+//		defer mc.TrackErr(RPC, &err)()
+func (mc *MetricContainer) TrackErr(alias int, errp *error) func() {
+	sw := mc.Start(alias)
+	return func() {
+		sw.StopErr(*errp)
+	}
+}
+
+// Measure runs fn and records how long it took, also when it panics.
+func (mc *MetricContainer) Measure(alias int, fn func()) {
+	defer mc.Start(alias).Stop()
+	fn()
+}
+
+// MeasureErr runs fn and records how long it took, into the failure metric
+// when fn fails, and returns the error of fn.
+func (mc *MetricContainer) MeasureErr(alias int, fn func() error) (err error) {
+	defer mc.TrackErr(alias, &err)()
+	return fn()
+}
+
+// Failures returns the alias of the companion metric the error-aware
+// helpers record failed runs of alias into, it is the timing metric named
+// <name>.failed with the same labels, allocated on first use. Successful
+// runs only are recorded into alias.
+func (mc *MetricContainer) Failures(alias int) (failureAlias int) {
+	if failureAlias, ok := mc.failures.Load(alias); ok {
+		return failureAlias.(int)
+	}
+	m := mc.metrics()[alias]
+	if m == nil {
+		return alias
+	}
+	name, labels := m.meta()
+	failureAlias = mc.GetOrAlloc(name+".failed", labels...)
+	mc.failures.Store(alias, failureAlias)
+	return failureAlias
+}
@@ -0,0 +1,66 @@
+package base
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStopwatch(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	mc, err := NewMetricContainer("timer", WithMetricClock(clock))
+	if err != nil {
+		t.Fatalf("new metric container, %s", err)
+	}
+	CALL := mc.GetOrAlloc("call", Label{Key: "api", Value: "get"})
+
+	sw := mc.Start(CALL)
+	clock.Advance(time.Millisecond)
+	if d := sw.Stop(); d != time.Millisecond {
+		t.Fatalf("elapse:%s", d)
+	}
+
+	mc.Measure(CALL, func() {
+		clock.Advance(2 * time.Millisecond)
+	})
+	func() {
+		defer mc.Track(CALL)()
+		clock.Advance(3 * time.Millisecond)
+	}()
+
+	fail := errors.New("fail")
+	if err := mc.MeasureErr(CALL, func() error {
+		clock.Advance(4 * time.Millisecond)
+		return fail
+	}); err != fail {
+		t.Fatalf("measure err:%v", err)
+	}
+	call := func(err error) (rerr error) {
+		defer mc.TrackErr(CALL, &rerr)()
+		clock.Advance(5 * time.Millisecond)
+		return err
+	}
+	call(nil)
+	call(fail)
+	mc.Start(CALL).StopErr(fail)
+
+	FAILED, ok := mc.Lookup("call.failed", Label{Key: "api", Value: "get"})
+	if !ok || mc.Failures(CALL) != FAILED {
+		t.Fatalf("failure metric not allocated")
+	}
+	snaps := mc.Snapshot()
+	if s := snaps[CALL]; s.Times != 4 || s.Total != uint64(11*time.Millisecond) {
+		t.Fatalf("call:%+v", s)
+	}
+	if s := snaps[FAILED]; s.Times != 3 || s.Total != uint64(9*time.Millisecond) {
+		t.Fatalf("failed:%+v", s)
+	}
+}
+
+func BenchmarkStopwatch(b *testing.B) {
+	mc := NewMC(b, "bench")
+	BENCH := mc.Alloc("bench")
+	for i := 0; i < b.N; i++ {
+		mc.Start(BENCH).Stop()
+	}
+}
@@ -1,31 +1,631 @@
 package base
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrPoolStopped = errors.New("routine pool stopped")
+	ErrPoolFull    = errors.New("routine pool queue full")
+	ErrTaskDropped = errors.New("task dropped from routine pool queue")
+)
+
 type Task interface {
 	Run()
 }
 
+// TaskFunc adapts a function to Task.
+type TaskFunc func()
+
+func (f TaskFunc) Run() {
+	f()
+}
+
+// PanicError is the error of a submitted task that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panic: %v", e.Value)
+}
+
+// Future is the pending result of a task given to Submit.
+type Future struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// Done is closed once the task has finished.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the task has finished and returns its result.
+func (f *Future) Wait() (interface{}, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+type futureTask struct {
+	f  *Future
+	fn func() (interface{}, error)
+}
+
+func (ft *futureTask) Run() {
+	defer close(ft.f.done)
+	defer func() {
+		if r := recover(); r != nil {
+			ft.f.err = &PanicError{Value: r, Stack: stack()}
+			panic(r)
+		}
+	}()
+	ft.f.result, ft.f.err = ft.fn()
+}
+
+// reject fails the future of a task that never ran
+func (ft *futureTask) reject(err error) {
+	ft.f.err = err
+	close(ft.f.done)
+}
+
+func stack() []byte {
+	buf := make([]byte, 4096)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+// RejectPolicy decides what happens to a task given to a pool with a full queue.
+type RejectPolicy uint8
+
+const (
+	RejectBlock      RejectPolicy = iota // wait for room in the queue
+	RejectDropNewest                     // refuse the task with ErrPoolFull
+	RejectDropOldest                     // drop the oldest queued task to make room
+	RejectCallerRuns                     // run the task in the caller goroutine
+)
+
+// Priority selects the lane of a task, workers always take a task from the
+// highest non-empty lane.
+type Priority uint8
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	priorities
+)
+
 type RoutinePool struct {
-	recv chan Task
+	lanes       [priorities]chan Task
+	keyed       []chan Task // every lane is consumed by its own worker
+	queueSize   int
+	policy      RejectPolicy
+	minWorkers  int32
+	maxWorkers  int32
+	idleTimeout time.Duration
+	onPanic     func(t Task, err *PanicError)
+
+	workers   int32
+	idle      int32
+	completed uint64
+	rejected  uint64
+
+	mc            *MetricContainer
+	execAlias     int
+	activeAlias   int
+	queuedAlias   int
+	rejectedAlias int
+
+	mu      sync.RWMutex // guards stopped against sends on closed lanes
+	stopped bool
+	done    chan struct{}  // closed by Stop, blocked senders give up
+	senders sync.WaitGroup // blocked senders, lanes are closed once they left
+	wg      sync.WaitGroup
+}
+
+// RoutinePoolStats is a point in time view of a RoutinePool.
+type RoutinePoolStats struct {
+	Workers   int // started workers
+	Active    int // workers running a task
+	Queued    int // tasks waiting for a worker
+	Completed uint64
+	Rejected  uint64
+}
+
+type routinePoolOption func(*RoutinePool)
+
+// WithWorkers overrides the number of worker goroutines.
+func WithWorkers(n int) routinePoolOption {
+	return func(p *RoutinePool) {
+		if n <= 0 {
+			panic("workers must be positive")
+		}
+		p.minWorkers, p.maxWorkers = int32(n), int32(n)
+	}
+}
+
+// WithElasticWorkers keeps between min and max workers: workers are spawned
+// when a task finds none idle and reaped after idleTimeout without tasks.
+func WithElasticWorkers(min, max int, idleTimeout time.Duration) routinePoolOption {
+	return func(p *RoutinePool) {
+		if min < 0 || max <= 0 || min > max {
+			panic("workers bounds must satisfy 0 <= min <= max, 0 < max")
+		}
+		if idleTimeout <= 0 {
+			panic("idle timeout must be positive")
+		}
+		p.minWorkers, p.maxWorkers, p.idleTimeout = int32(min), int32(max), idleTimeout
+	}
+}
+
+// WithQueueSize overrides the number of tasks waiting for a worker, per
+// priority and keyed lane.
+func WithQueueSize(n int) routinePoolOption {
+	return func(p *RoutinePool) {
+		if n < 0 {
+			panic("queue size cannot be negative")
+		}
+		p.queueSize = n
+	}
 }
 
-func NewRoutinePool(cap uint16) *RoutinePool {
+// WithKeyedLanes enables RunKeyed with n lanes, each run serially by a
+// dedicated worker besides the pool workers.
+func WithKeyedLanes(n int) routinePoolOption {
+	return func(p *RoutinePool) {
+		if n <= 0 {
+			panic("keyed lanes must be positive")
+		}
+		p.keyed = make([]chan Task, n)
+	}
+}
+
+// WithRejectPolicy chooses how Run and RunContext handle a full queue,
+// RejectBlock by default.
+func WithRejectPolicy(policy RejectPolicy) routinePoolOption {
+	return func(p *RoutinePool) {
+		p.policy = policy
+	}
+}
+
+// WithPanicHandler is called with the recovered panic of a task instead of
+// logging it, the worker goes on with the next task either way.
+func WithPanicHandler(h func(t Task, err *PanicError)) routinePoolOption {
+	return func(p *RoutinePool) {
+		p.onPanic = h
+	}
+}
+
+// WithMetricContainer records into mc under the given name prefix: task run
+// time (.exec), gauges of the running and queued tasks (.active, .queued),
+// and a counter of rejected tasks (.rejected). Pools given the same name
+// share their metrics, the gauges then add up the pools.
+func WithMetricContainer(mc *MetricContainer, name string) routinePoolOption {
+	return func(p *RoutinePool) {
+		p.mc = mc
+		p.execAlias = mc.GetOrAlloc(name + ".exec")
+		p.activeAlias = mc.GetOrAllocGauge(name + ".active")
+		p.queuedAlias = mc.GetOrAllocGauge(name + ".queued")
+		p.rejectedAlias = mc.GetOrAllocCounter(name + ".rejected")
+	}
+}
+
+// NewRoutinePool starts cap workers with a queue of cap tasks, options change either.
+func NewRoutinePool(cap uint16, options ...routinePoolOption) *RoutinePool {
 	pool := &RoutinePool{
-		recv: make(chan Task, cap),
+		queueSize:  int(cap),
+		done:       make(chan struct{}),
+		minWorkers: int32(cap),
+		maxWorkers: int32(cap),
+		onPanic: func(t Task, err *PanicError) {
+			log.Printf("routine pool, %s\n%s", err, err.Stack)
+		},
+	}
+	for _, option := range options {
+		option(pool)
+	}
+	if pool.maxWorkers <= 0 {
+		panic("workers must be positive")
+	}
+	for i := range pool.lanes {
+		pool.lanes[i] = make(chan Task, pool.queueSize)
+	}
+	for i := range pool.keyed {
+		pool.keyed[i] = make(chan Task, pool.queueSize)
+		pool.wg.Add(1)
+		go pool.workKeyed(pool.keyed[i])
 	}
 
-	for i := 0; i < int(cap); i++ {
-		go func(recv chan Task) {
-			for {
-				select {
-				case t := <-recv:
-					t.Run()
-				}
-			}
-		}(pool.recv)
+	for i := int32(0); i < pool.minWorkers; i++ {
+		pool.workers++
+		pool.startWorker()
 	}
 	return pool
 }
 
-func (p *RoutinePool) Run(t Task) {
-	p.recv <- t
+// spawn starts one more worker when the queued tasks plus pending ones
+// outnumber idle workers and max is not reached
+func (p *RoutinePool) spawn(pending int) {
+	for pending+p.queued() > int(atomic.LoadInt32(&p.idle)) {
+		n := atomic.LoadInt32(&p.workers)
+		if n >= p.maxWorkers {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&p.workers, n, n+1) {
+			p.startWorker()
+			return
+		}
+	}
+}
+
+// startWorker runs a worker already counted in workers, it starts idle
+func (p *RoutinePool) startWorker() {
+	atomic.AddInt32(&p.idle, 1)
+	p.wg.Add(1)
+	go p.work()
+}
+
+// retire lets an idle worker exit while there are more than min workers
+func (p *RoutinePool) retire() bool {
+	// stop counting as idle first, so that a concurrent Run either spawns a
+	// new worker or queued its task before we look at the queue
+	atomic.AddInt32(&p.idle, -1)
+	for {
+		n := atomic.LoadInt32(&p.workers)
+		if n <= p.minWorkers {
+			atomic.AddInt32(&p.idle, 1)
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.workers, n, n-1) {
+			break
+		}
+	}
+	if p.queued() > 0 {
+		// a task came in while nobody looked
+		atomic.AddInt32(&p.workers, 1)
+		atomic.AddInt32(&p.idle, 1)
+		return false
+	}
+	return true
+}
+
+// queued returns the number of tasks waiting for pool workers
+func (p *RoutinePool) queued() (n int) {
+	for _, lane := range p.lanes {
+		n += len(lane)
+	}
+	return
+}
+
+func (p *RoutinePool) work() {
+	defer p.wg.Done()
+
+	var (
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	if p.idleTimeout > 0 {
+		timer = time.NewTimer(p.idleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// lanes are set to nil once closed, nil channels never get selected
+	lanes := p.lanes
+	for lanes[PriorityHigh] != nil || lanes[PriorityNormal] != nil || lanes[PriorityLow] != nil {
+		if timer != nil {
+			resetTimer(timer, p.idleTimeout)
+		}
+
+		t, ok, from := p.next(&lanes, timeout)
+		if from == priorities {
+			// idle timeout
+			if p.retire() {
+				return
+			}
+			continue
+		}
+		if !ok {
+			// closed by Stop, keep draining the other lanes
+			lanes[from] = nil
+			continue
+		}
+		p.dequeued()
+		atomic.AddInt32(&p.idle, -1)
+		p.exec(t)
+		atomic.AddInt32(&p.idle, 1)
+	}
+	atomic.AddInt32(&p.idle, -1)
+	atomic.AddInt32(&p.workers, -1)
+}
+
+// next receives from the highest non-empty lane, from is priorities on timeout
+func (p *RoutinePool) next(lanes *[priorities]chan Task, timeout <-chan time.Time) (t Task, ok bool, from Priority) {
+	high, normal, low := lanes[PriorityHigh], lanes[PriorityNormal], lanes[PriorityLow]
+	select {
+	case t, ok = <-high:
+		return t, ok, PriorityHigh
+	default:
+	}
+	select {
+	case t, ok = <-high:
+		return t, ok, PriorityHigh
+	case t, ok = <-normal:
+		return t, ok, PriorityNormal
+	default:
+	}
+	select {
+	case t, ok = <-high:
+		return t, ok, PriorityHigh
+	case t, ok = <-normal:
+		return t, ok, PriorityNormal
+	case t, ok = <-low:
+		return t, ok, PriorityLow
+	case <-timeout:
+		return nil, false, priorities
+	}
+}
+
+func (p *RoutinePool) workKeyed(lane chan Task) {
+	defer p.wg.Done()
+	for t := range lane {
+		p.dequeued()
+		p.exec(t)
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func (p *RoutinePool) exec(t Task) {
+	var sw Stopwatch
+	defer func() {
+		if r := recover(); r != nil {
+			p.onPanic(t, &PanicError{Value: r, Stack: stack()})
+		}
+		atomic.AddUint64(&p.completed, 1)
+		if p.mc != nil {
+			sw.Stop()
+			p.mc.AddGauge(p.activeAlias, -1)
+		}
+	}()
+	if p.mc != nil {
+		p.mc.AddGauge(p.activeAlias, 1)
+		sw = p.mc.Start(p.execAlias)
+	}
+	t.Run()
+}
+
+// reject accounts for a task that will never run, a future gets err
+func (p *RoutinePool) reject(t Task, err error) error {
+	atomic.AddUint64(&p.rejected, 1)
+	if p.mc != nil {
+		p.mc.AddCounter(p.rejectedAlias, 1)
+	}
+	if ft, ok := t.(*futureTask); ok {
+		ft.reject(err)
+	}
+	return err
+}
+
+// Stats returns the current load of the pool.
+func (p *RoutinePool) Stats() RoutinePoolStats {
+	workers := atomic.LoadInt32(&p.workers)
+	queued := p.queued()
+	for _, lane := range p.keyed {
+		queued += len(lane)
+	}
+	return RoutinePoolStats{
+		Workers:   int(workers),
+		Active:    int(workers - atomic.LoadInt32(&p.idle)),
+		Queued:    queued,
+		Completed: atomic.LoadUint64(&p.completed),
+		Rejected:  atomic.LoadUint64(&p.rejected),
+	}
+}
+
+// Run queues t, a full queue is handled by the reject policy.
+func (p *RoutinePool) Run(t Task) error {
+	return p.enqueue(nil, p.lanes[PriorityNormal], t, p.policy)
+}
+
+// RunContext is Run giving up with ctx.Err() when ctx is done before the
+// task could be queued.
+func (p *RoutinePool) RunContext(ctx context.Context, t Task) error {
+	if err := ctx.Err(); err != nil {
+		return p.reject(t, err)
+	}
+	return p.enqueue(ctx, p.lanes[PriorityNormal], t, p.policy)
+}
+
+// TryRun queues t only if there is room, otherwise returns ErrPoolFull.
+func (p *RoutinePool) TryRun(t Task) error {
+	return p.enqueue(nil, p.lanes[PriorityNormal], t, RejectDropNewest)
+}
+
+// RunPriority is Run on the lane of prio.
+func (p *RoutinePool) RunPriority(prio Priority, t Task) error {
+	if prio >= priorities {
+		panic("unknown priority")
+	}
+	return p.enqueue(nil, p.lanes[prio], t, p.policy)
+}
+
+// RunKeyed queues t on the keyed lane of key, tasks sharing a key run one
+// after another in queuing order while different keys run in parallel. The
+// pool must be built WithKeyedLanes, RejectCallerRuns blocks instead since
+// running in the caller would break the order.
+func (p *RoutinePool) RunKeyed(key string, t Task) error {
+	if len(p.keyed) == 0 {
+		panic("routine pool without keyed lanes")
+	}
+	policy := p.policy
+	if policy == RejectCallerRuns {
+		policy = RejectBlock
+	}
+	return p.enqueue(nil, p.keyed[StringHashCode(key)%len(p.keyed)], t, policy)
+}
+
+// what is left to do with a task tryEnqueue could not queue
+type enqueueAction uint8
+
+const (
+	enqueueDone       enqueueAction = iota
+	enqueueBlock                    // send blocking
+	enqueueCallerRuns               // run in the caller
+)
+
+// enqueue never blocks nor runs a task holding mu, Stop would wait for it
+// while a task blocked on a full queue, or run in the caller, waits for Stop
+func (p *RoutinePool) enqueue(ctx context.Context, lane chan Task, t Task, policy RejectPolicy) error {
+	p.mu.RLock()
+	if p.stopped {
+		p.mu.RUnlock()
+		return p.reject(t, ErrPoolStopped)
+	}
+	action, err := p.tryEnqueue(lane, t, policy)
+	if action == enqueueBlock {
+		p.senders.Add(1)
+	}
+	p.mu.RUnlock()
+	switch action {
+	case enqueueDone:
+		return err
+	case enqueueCallerRuns:
+		p.exec(t)
+		return nil
+	}
+
+	defer p.senders.Done()
+	var cancel <-chan struct{}
+	if ctx != nil {
+		cancel = ctx.Done()
+	}
+	select {
+	case lane <- t:
+		p.enqueued()
+		return nil
+	case <-p.done:
+		return p.reject(t, ErrPoolStopped)
+	case <-cancel:
+		return p.reject(t, ctx.Err())
+	}
+}
+
+// tryEnqueue must be called with mu held, it applies the policies that
+// neither block nor run t and reports what is left to do
+func (p *RoutinePool) tryEnqueue(lane chan Task, t Task, policy RejectPolicy) (action enqueueAction, err error) {
+	select {
+	case lane <- t:
+		p.enqueued()
+		return enqueueDone, nil
+	default:
+	}
+
+	p.spawn(1)
+	if policy == RejectDropOldest && cap(lane) == 0 {
+		// nothing queued to drop
+		policy = RejectBlock
+	}
+	switch policy {
+	case RejectDropNewest:
+		select {
+		case lane <- t:
+		default:
+			return enqueueDone, p.reject(t, ErrPoolFull)
+		}
+	case RejectDropOldest:
+		for {
+			select {
+			case lane <- t:
+				p.enqueued()
+				return enqueueDone, nil
+			default:
+			}
+			select {
+			case old := <-lane:
+				p.dequeued()
+				p.reject(old, ErrTaskDropped)
+			default:
+			}
+		}
+	case RejectCallerRuns:
+		select {
+		case lane <- t:
+		default:
+			return enqueueCallerRuns, nil
+		}
+	default:
+		return enqueueBlock, nil
+	}
+	p.enqueued()
+	return enqueueDone, nil
+}
+
+// enqueued runs after a task entered the queue
+func (p *RoutinePool) enqueued() {
+	p.spawn(0)
+	if p.mc != nil {
+		p.mc.AddGauge(p.queuedAlias, 1)
+	}
+}
+
+// dequeued runs after a task left the queue, to run or to be dropped
+func (p *RoutinePool) dequeued() {
+	if p.mc != nil {
+		p.mc.AddGauge(p.queuedAlias, -1)
+	}
+}
+
+// Submit queues fn and returns the future of its result, a panic in fn
+// fails the future with a *PanicError.
+func (p *RoutinePool) Submit(fn func() (interface{}, error)) (*Future, error) {
+	f := &Future{done: make(chan struct{})}
+	if err := p.Run(&futureTask{f: f, fn: fn}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stop refuses new tasks, workers exit once the queued tasks are drained.
+// Runs blocked on a full queue give up with ErrPoolStopped.
+func (p *RoutinePool) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.done)
+	p.mu.Unlock()
+
+	p.senders.Wait()
+	for _, lane := range p.lanes {
+		close(lane)
+	}
+	for _, lane := range p.keyed {
+		close(lane)
+	}
+}
+
+// StopWait stops the pool and waits until all queued tasks have run.
+func (p *RoutinePool) StopWait() {
+	p.Stop()
+	p.wg.Wait()
 }
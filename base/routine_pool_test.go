@@ -1,8 +1,10 @@
 package base
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"time"
 )
 
 type task struct {
@@ -43,3 +45,408 @@ func TestRoutine(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestRoutinePoolStopWait(t *testing.T) {
+	pool := NewRoutinePool(2, WithWorkers(1), WithQueueSize(100))
+	var (
+		mu   sync.Mutex
+		done int
+	)
+	for i := 0; i < 100; i++ {
+		err := pool.Run(TaskFunc(func() {
+			mu.Lock()
+			done++
+			mu.Unlock()
+		}))
+		if err != nil {
+			t.Fatalf("run, %s", err)
+		}
+	}
+	pool.StopWait()
+	if done != 100 {
+		t.Fatalf("drained tasks:%d", done)
+	}
+	if err := pool.Run(TaskFunc(func() {})); err != ErrPoolStopped {
+		t.Fatalf("run after stop, err:%v", err)
+	}
+	pool.Stop()
+}
+
+// a task blocked on the full queue of its own pool must not keep Stop waiting
+func TestRoutinePoolStopBlockedRun(t *testing.T) {
+	pool := NewRoutinePool(1)
+	running, full, errs := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	pool.Run(TaskFunc(func() {
+		close(running)
+		<-full
+		// the queue is full and the only worker is this one
+		errs <- pool.Run(TaskFunc(func() {}))
+	}))
+	<-running
+	pool.Run(TaskFunc(func() {}))
+	close(full)
+
+	time.Sleep(10 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		pool.StopWait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("stop deadlocked with a blocked run")
+	}
+	if err := <-errs; err != ErrPoolStopped {
+		t.Fatalf("blocked run, err:%v", err)
+	}
+}
+
+func TestRoutinePoolSubmit(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		panics []*PanicError
+	)
+	pool := NewRoutinePool(4, WithPanicHandler(func(task Task, err *PanicError) {
+		mu.Lock()
+		panics = append(panics, err)
+		mu.Unlock()
+	}))
+	defer pool.StopWait()
+
+	ok, err := pool.Submit(func() (interface{}, error) {
+		return 42, nil
+	})
+	if err != nil {
+		t.Fatalf("submit, %s", err)
+	}
+	failed, _ := pool.Submit(func() (interface{}, error) {
+		return nil, ErrPoolStopped
+	})
+	panicked, _ := pool.Submit(func() (interface{}, error) {
+		panic("boom")
+	})
+	pool.Run(TaskFunc(func() {
+		panic("plain task")
+	}))
+
+	if v, err := ok.Wait(); v != 42 || err != nil {
+		t.Fatalf("result:%v err:%v", v, err)
+	}
+	if _, err := failed.Wait(); err != ErrPoolStopped {
+		t.Fatalf("err:%v", err)
+	}
+	_, err = panicked.Wait()
+	if pe, ok := err.(*PanicError); !ok || pe.Value != "boom" {
+		t.Fatalf("err:%v", err)
+	}
+
+	// the workers survived the panics
+	again, _ := pool.Submit(func() (interface{}, error) {
+		return "alive", nil
+	})
+	if v, _ := again.Wait(); v != "alive" {
+		t.Fatalf("result:%v", v)
+	}
+
+	pool.StopWait()
+	if len(panics) != 2 {
+		t.Fatalf("panics:%v", panics)
+	}
+}
+
+func waitStats(t *testing.T, pool *RoutinePool, cond func(RoutinePoolStats) bool) RoutinePoolStats {
+	for i := 0; i < 1000; i++ {
+		if s := pool.Stats(); cond(s) {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s := pool.Stats()
+	t.Fatalf("stats:%+v", s)
+	return s
+}
+
+func TestRoutinePoolElastic(t *testing.T) {
+	pool := NewRoutinePool(0, WithElasticWorkers(1, 8, 20*time.Millisecond), WithQueueSize(16))
+	if s := pool.Stats(); s.Workers != 1 {
+		t.Fatalf("stats:%+v", s)
+	}
+
+	block := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		pool.Run(TaskFunc(func() {
+			<-block
+		}))
+	}
+	s := waitStats(t, pool, func(s RoutinePoolStats) bool {
+		return s.Active == 8
+	})
+	t.Logf("busy stats:%+v", s)
+	if s.Workers != 8 {
+		t.Fatalf("stats:%+v", s)
+	}
+
+	close(block)
+	s = waitStats(t, pool, func(s RoutinePoolStats) bool {
+		return s.Workers == 1
+	})
+	t.Logf("reaped stats:%+v", s)
+	if s.Completed != 8 || s.Active != 0 {
+		t.Fatalf("stats:%+v", s)
+	}
+
+	// the last worker is never reaped
+	time.Sleep(50 * time.Millisecond)
+	if s := pool.Stats(); s.Workers != 1 {
+		t.Fatalf("stats:%+v", s)
+	}
+	pool.StopWait()
+	if s := pool.Stats(); s.Workers != 0 {
+		t.Fatalf("stats:%+v", s)
+	}
+}
+
+func TestRoutinePoolElasticFromZero(t *testing.T) {
+	pool := NewRoutinePool(0, WithElasticWorkers(0, 2, 10*time.Millisecond), WithQueueSize(0))
+	for i := 0; i < 10; i++ {
+		f, err := pool.Submit(func() (interface{}, error) {
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("submit, %s", err)
+		}
+		f.Wait()
+	}
+	waitStats(t, pool, func(s RoutinePoolStats) bool {
+		return s.Workers == 0 && s.Completed == 10
+	})
+	pool.StopWait()
+}
+
+func TestRoutinePoolMetric(t *testing.T) {
+	mc := NewMC(t, "pool")
+	pool := NewRoutinePool(1, WithMetricContainer(mc, "pool"))
+	for i := 0; i < 10; i++ {
+		pool.Run(TaskFunc(func() {
+			time.Sleep(time.Millisecond)
+		}))
+	}
+	pool.StopWait()
+	pool.Run(TaskFunc(func() {}))
+
+	if s := pool.Stats(); s.Completed != 10 || s.Rejected != 1 {
+		t.Fatalf("stats:%+v", s)
+	}
+	other := NewRoutinePool(1, WithMetricContainer(mc, "pool"), WithRejectPolicy(RejectDropOldest))
+	for i := 0; i < 10; i++ {
+		other.Run(TaskFunc(func() {
+			time.Sleep(time.Millisecond)
+		}))
+	}
+	other.StopWait()
+	if n := len(mc.Snapshot()); n != 4 {
+		t.Fatalf("metrics:%d", n)
+	}
+	ACTIVE, _ := mc.Lookup("pool.active")
+	QUEUED, _ := mc.Lookup("pool.queued")
+	REJECTED, _ := mc.Lookup("pool.rejected")
+	snaps := mc.Snapshot()
+	if snaps[QUEUED].Kind != KindGauge || snaps[ACTIVE].Value != 0 || snaps[QUEUED].Value != 0 {
+		t.Fatalf("gauges after stop, active:%+v queued:%+v", snaps[ACTIVE], snaps[QUEUED])
+	}
+	if rejected := 1 + other.Stats().Rejected; uint64(snaps[REJECTED].Value) != rejected {
+		t.Fatalf("rejected:%d expect:%d", snaps[REJECTED].Value, rejected)
+	}
+	ctt, err := mc.Count()
+	if err != nil {
+		t.Fatalf("metric container count, %s", err)
+	}
+	t.Log(ctt)
+}
+
+// busyPool returns a pool whose only worker is blocked and whose queue of one is full
+func busyPool(t *testing.T, policy RejectPolicy) (*RoutinePool, chan struct{}, *Future) {
+	block, running := make(chan struct{}), make(chan struct{})
+	pool := NewRoutinePool(1, WithRejectPolicy(policy))
+	pool.Run(TaskFunc(func() {
+		close(running)
+		<-block
+	}))
+	<-running
+	queued, err := pool.Submit(func() (interface{}, error) {
+		return "queued", nil
+	})
+	if err != nil {
+		t.Fatalf("submit, %s", err)
+	}
+	return pool, block, queued
+}
+
+func TestRoutinePoolTryRun(t *testing.T) {
+	pool, block, queued := busyPool(t, RejectBlock)
+	if err := pool.TryRun(TaskFunc(func() {})); err != ErrPoolFull {
+		t.Fatalf("try run, err:%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.RunContext(ctx, TaskFunc(func() {})); err != context.DeadlineExceeded {
+		t.Fatalf("run context, err:%v", err)
+	}
+
+	close(block)
+	if v, _ := queued.Wait(); v != "queued" {
+		t.Fatalf("result:%v", v)
+	}
+	if err := pool.RunContext(context.Background(), TaskFunc(func() {})); err != nil {
+		t.Fatalf("run context, err:%v", err)
+	}
+	// the queue has room, a cancelled ctx still refuses the task
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.RunContext(cancelled, TaskFunc(func() {
+		t.Errorf("task of a cancelled ctx ran")
+	})); err != context.Canceled {
+		t.Fatalf("run cancelled context, err:%v", err)
+	}
+	pool.StopWait()
+	if s := pool.Stats(); s.Rejected != 3 || s.Completed != 3 {
+		t.Fatalf("stats:%+v", s)
+	}
+}
+
+func TestRoutinePoolRejectPolicy(t *testing.T) {
+	pool, block, queued := busyPool(t, RejectDropNewest)
+	newest, err := pool.Submit(func() (interface{}, error) {
+		return "newest", nil
+	})
+	if err != ErrPoolFull || newest != nil {
+		t.Fatalf("drop newest, err:%v", err)
+	}
+	close(block)
+	if v, _ := queued.Wait(); v != "queued" {
+		t.Fatalf("result:%v", v)
+	}
+	pool.StopWait()
+
+	pool, block, queued = busyPool(t, RejectDropOldest)
+	newest, err = pool.Submit(func() (interface{}, error) {
+		return "newest", nil
+	})
+	if err != nil {
+		t.Fatalf("drop oldest, err:%v", err)
+	}
+	if _, err := queued.Wait(); err != ErrTaskDropped {
+		t.Fatalf("dropped future, err:%v", err)
+	}
+	close(block)
+	if v, _ := newest.Wait(); v != "newest" {
+		t.Fatalf("result:%v", v)
+	}
+	pool.StopWait()
+
+	pool, block, queued = busyPool(t, RejectCallerRuns)
+	caller := make(chan int, 1)
+	gid := GoID()
+	if err := pool.Run(TaskFunc(func() { caller <- GoID() })); err != nil {
+		t.Fatalf("caller runs, err:%v", err)
+	}
+	if id := <-caller; id != gid {
+		t.Fatalf("ran on goroutine %d, caller %d", id, gid)
+	}
+	close(block)
+	queued.Wait()
+	pool.StopWait()
+}
+
+// a task run in the caller may stop its pool
+func TestRoutinePoolCallerRunsStop(t *testing.T) {
+	pool, block, queued := busyPool(t, RejectCallerRuns)
+	ran := make(chan struct{})
+	go func() {
+		pool.Run(TaskFunc(func() {
+			pool.Stop()
+			close(ran)
+		}))
+	}()
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatalf("stop deadlocked in a task run by the caller")
+	}
+	close(block)
+	if v, _ := queued.Wait(); v != "queued" {
+		t.Fatalf("result:%v", v)
+	}
+	pool.StopWait()
+}
+
+func TestRoutinePoolPriority(t *testing.T) {
+	block, running := make(chan struct{}), make(chan struct{})
+	pool := NewRoutinePool(1, WithQueueSize(10))
+	pool.Run(TaskFunc(func() {
+		close(running)
+		<-block
+	}))
+	<-running
+
+	var (
+		mu    sync.Mutex
+		order []Priority
+	)
+	for _, prio := range []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityLow, PriorityHigh, PriorityNormal} {
+		prio := prio
+		pool.RunPriority(prio, TaskFunc(func() {
+			mu.Lock()
+			order = append(order, prio)
+			mu.Unlock()
+		}))
+	}
+	close(block)
+	pool.StopWait()
+
+	expect := []Priority{PriorityHigh, PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow, PriorityLow}
+	if len(order) != len(expect) {
+		t.Fatalf("order:%v", order)
+	}
+	for i := range expect {
+		if order[i] != expect[i] {
+			t.Fatalf("order:%v", order)
+		}
+	}
+}
+
+func TestRoutinePoolKeyed(t *testing.T) {
+	pool := NewRoutinePool(4, WithKeyedLanes(4), WithQueueSize(64))
+	var (
+		mu   sync.Mutex
+		seen = make(map[string][]int)
+		gids = make(map[string]map[int]bool)
+	)
+	keys := []string{"service-a", "service-b", "service-c", "service-d", "service-e"}
+	for i := 0; i < 100; i++ {
+		key, seq := keys[i%len(keys)], i
+		pool.RunKeyed(key, TaskFunc(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[key] = append(seen[key], seq)
+			if gids[key] == nil {
+				gids[key] = make(map[int]bool)
+			}
+			gids[key][GoID()] = true
+		}))
+	}
+	pool.StopWait()
+
+	for _, key := range keys {
+		if len(seen[key]) != 100/len(keys) || len(gids[key]) != 1 {
+			t.Fatalf("key:%s seen:%v workers:%d", key, seen[key], len(gids[key]))
+		}
+		for i := 1; i < len(seen[key]); i++ {
+			if seen[key][i] < seen[key][i-1] {
+				t.Fatalf("key:%s out of order:%v", key, seen[key])
+			}
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package base
+
+import (
+	"container/heap"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the time source of a Scheduler, FakeClock makes tests deterministic.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// FakeClock only moves forward when told to with Advance.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	t := &fakeTimer{
+		clock: fc,
+		at:    fc.now.Add(d),
+		c:     make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.c <- fc.now
+	} else {
+		fc.timers[t] = struct{}{}
+	}
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers that expired.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+	for t := range fc.timers {
+		if !t.at.After(fc.now) {
+			delete(fc.timers, t)
+			t.c <- fc.now
+		}
+	}
+}
+
+// Timers returns the number of pending timers, tests use it to know that a
+// scheduler went back to waiting.
+func (fc *FakeClock) Timers() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.timers)
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, ok := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return ok
+}
+
+// ScheduledTask is the handle of a task given to a Scheduler.
+type ScheduledTask struct {
+	s          *Scheduler
+	t          Task
+	at         time.Time // when to run, next delayed by the jitter
+	next       time.Time // nominal time of the next run
+	seq        uint64
+	index      int // in the heap, -1 when not in it
+	interval   time.Duration
+	jitter     time.Duration
+	fixedDelay bool
+	cancelled  int32
+}
+
+// Cancel stops future runs and drops the task from the scheduler, a run
+// already handed to the pool still happens. It reports whether the task
+// was not cancelled before.
+func (st *ScheduledTask) Cancel() bool {
+	if !atomic.CompareAndSwapInt32(&st.cancelled, 0, 1) {
+		return false
+	}
+	st.s.mu.Lock()
+	if st.index >= 0 {
+		heap.Remove(&st.s.h, st.index)
+	}
+	st.s.mu.Unlock()
+	return true
+}
+
+func (st *ScheduledTask) Cancelled() bool {
+	return atomic.LoadInt32(&st.cancelled) == 1
+}
+
+func (st *ScheduledTask) delay() time.Duration {
+	if st.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(st.jitter)))
+}
+
+type scheduledHeap []*ScheduledTask
+
+func (h scheduledHeap) Len() int {
+	return len(h)
+}
+
+func (h scheduledHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h scheduledHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *scheduledHeap) Push(x interface{}) {
+	st := x.(*ScheduledTask)
+	st.index = len(*h)
+	*h = append(*h, st)
+}
+
+func (h *scheduledHeap) Pop() interface{} {
+	old := *h
+	st := old[len(old)-1]
+	st.index = -1
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return st
+}
+
+// Scheduler runs delayed and periodic tasks on a RoutinePool, pending tasks
+// are kept in a heap ordered by time and waited for by a single goroutine.
+type Scheduler struct {
+	pool     *RoutinePool
+	clock    Clock
+	onReject func(st *ScheduledTask, err error)
+
+	mu   sync.Mutex
+	h    scheduledHeap
+	seq  uint64
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type schedulerOption func(*Scheduler)
+
+// WithSchedulerClock sets the clock delays are measured and waited with.
+func WithSchedulerClock(c Clock) schedulerOption {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// WithRejectHandler is called instead of logging when the pool refuses a
+// run, see TryRun. Refused runs are not retried, periodic tasks go on with
+// their next run.
+func WithRejectHandler(h func(st *ScheduledTask, err error)) schedulerOption {
+	return func(s *Scheduler) {
+		s.onReject = h
+	}
+}
+
+func NewScheduler(pool *RoutinePool, options ...schedulerOption) *Scheduler {
+	s := &Scheduler{
+		pool:  pool,
+		clock: realClock{},
+		onReject: func(st *ScheduledTask, err error) {
+			log.Printf("scheduler, run refused, %s", err)
+		},
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	go s.loop()
+	return s
+}
+
+type everyOption func(*ScheduledTask)
+
+// WithJitter delays every run by a random duration in [0, jitter).
+func WithJitter(jitter time.Duration) everyOption {
+	return func(st *ScheduledTask) {
+		if jitter < 0 {
+			panic("jitter cannot be negative")
+		}
+		st.jitter = jitter
+	}
+}
+
+// WithFixedDelay waits interval after a run finished before the next one,
+// instead of starting runs every interval regardless of how long they take.
+func WithFixedDelay() everyOption {
+	return func(st *ScheduledTask) {
+		st.fixedDelay = true
+	}
+}
+
+func (s *Scheduler) RunAfter(d time.Duration, t Task) *ScheduledTask {
+	return s.RunAt(s.clock.Now().Add(d), t)
+}
+
+func (s *Scheduler) RunAt(at time.Time, t Task) *ScheduledTask {
+	st := &ScheduledTask{
+		s:     s,
+		t:     t,
+		at:    at,
+		index: -1,
+	}
+	s.push(st)
+	return st
+}
+
+// RunEvery runs t every interval, the first run one interval from now.
+// Fixed rate runs keep to the nominal schedule, the jitter only delays each
+// run. Runs missed when falling behind are skipped, the next one is at the
+// first slot after now.
+func (s *Scheduler) RunEvery(interval time.Duration, t Task, options ...everyOption) *ScheduledTask {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	st := &ScheduledTask{
+		s:        s,
+		t:        t,
+		interval: interval,
+		index:    -1,
+	}
+	for _, option := range options {
+		option(st)
+	}
+	st.next = s.clock.Now().Add(interval)
+	st.at = st.next.Add(st.delay())
+	s.push(st)
+	return st
+}
+
+// push skips cancelled tasks under mu, so that a task is either never
+// pushed or removed by Cancel
+func (s *Scheduler) push(st *ScheduledTask) {
+	s.mu.Lock()
+	if st.Cancelled() {
+		s.mu.Unlock()
+		return
+	}
+	s.seq++
+	st.seq = s.seq
+	heap.Push(&s.h, st)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of tasks waiting for their time, cancelled ones
+// are not counted.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.h)
+}
+
+// Stop ends the scheduler, pending tasks never run. The pool is left running.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+	for {
+		due, wait := s.due()
+		for _, st := range due {
+			s.dispatch(st)
+		}
+
+		var (
+			timer ClockTimer
+			fire  <-chan time.Time
+		)
+		if wait >= 0 {
+			timer = s.clock.NewTimer(wait)
+			fire = timer.C()
+		}
+		select {
+		case <-fire:
+		case <-s.wake:
+		case <-s.stop:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+}
+
+// due pops the tasks whose time has come and returns how long to wait for
+// the next one, -1 when there is none
+func (s *Scheduler) due() (due []*ScheduledTask, wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	for len(s.h) > 0 {
+		st := s.h[0]
+		if st.Cancelled() {
+			heap.Pop(&s.h)
+			continue
+		}
+		if st.at.After(now) {
+			return due, st.at.Sub(now)
+		}
+		heap.Pop(&s.h)
+		due = append(due, st)
+
+		if st.interval > 0 && !st.fixedDelay {
+			// fixed rate, the next run is scheduled right away
+			st.next = st.next.Add(st.interval)
+			if !st.next.After(now) {
+				missed := now.Sub(st.next)/st.interval + 1
+				st.next = st.next.Add(missed * st.interval)
+			}
+			st.at = st.next.Add(st.delay())
+			s.seq++
+			st.seq = s.seq
+			heap.Push(&s.h, st)
+		}
+	}
+	return due, -1
+}
+
+// dispatch never blocks the loop on the pool, a full pool refuses the run
+func (s *Scheduler) dispatch(st *ScheduledTask) {
+	fixedDelay := st.interval > 0 && st.fixedDelay
+	t := st.t
+	if fixedDelay {
+		t = TaskFunc(func() {
+			defer s.reschedule(st)
+			st.t.Run()
+		})
+	}
+	if err := s.pool.TryRun(t); err != nil {
+		s.onReject(st, err)
+		if fixedDelay {
+			s.reschedule(st)
+		}
+	}
+}
+
+// reschedule pushes a fixed delay task one interval from now
+func (s *Scheduler) reschedule(st *ScheduledTask) {
+	if st.Cancelled() {
+		return
+	}
+	s.mu.Lock()
+	st.next = s.clock.Now().Add(st.interval)
+	st.at = st.next.Add(st.delay())
+	s.mu.Unlock()
+	s.push(st)
+}
@@ -0,0 +1,248 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func waitTimers(t *testing.T, clock *FakeClock, n int) {
+	for i := 0; i < 1000; i++ {
+		if clock.Timers() == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timers:%d expect:%d", clock.Timers(), n)
+}
+
+func expectRun(t *testing.T, ran chan string, name string) {
+	select {
+	case got := <-ran:
+		if got != name {
+			t.Fatalf("ran:%s expect:%s", got, name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not run", name)
+	}
+}
+
+func expectIdle(t *testing.T, ran chan string) {
+	select {
+	case got := <-ran:
+		t.Fatalf("unexpected run:%s", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func sendTask(ran chan string, name string) Task {
+	return TaskFunc(func() {
+		ran <- name
+	})
+}
+
+func TestSchedulerRunAfter(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	pool := NewRoutinePool(2)
+	defer pool.StopWait()
+	s := NewScheduler(pool, WithSchedulerClock(clock))
+	defer s.Stop()
+
+	ran := make(chan string, 10)
+	s.RunAfter(2*time.Second, sendTask(ran, "second"))
+	s.RunAt(time.Unix(1, 0), sendTask(ran, "first"))
+	cancelled := s.RunAfter(time.Second, sendTask(ran, "cancelled"))
+	if !cancelled.Cancel() || cancelled.Cancel() {
+		t.Fatalf("cancel twice")
+	}
+	if n := s.Len(); n != 2 {
+		t.Fatalf("pending after cancel:%d", n)
+	}
+
+	waitTimers(t, clock, 1)
+	clock.Advance(999 * time.Millisecond)
+	expectIdle(t, ran)
+
+	clock.Advance(time.Millisecond)
+	expectRun(t, ran, "first")
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	expectRun(t, ran, "second")
+	expectIdle(t, ran)
+	if n := s.Len(); n != 0 {
+		t.Fatalf("pending:%d", n)
+	}
+}
+
+func TestSchedulerRunEvery(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	pool := NewRoutinePool(2)
+	defer pool.StopWait()
+	s := NewScheduler(pool, WithSchedulerClock(clock))
+	defer s.Stop()
+
+	ran := make(chan string, 10)
+	st := s.RunEvery(time.Second, sendTask(ran, "tick"))
+	for i := 0; i < 3; i++ {
+		waitTimers(t, clock, 1)
+		clock.Advance(time.Second)
+		expectRun(t, ran, "tick")
+	}
+
+	st.Cancel()
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	expectIdle(t, ran)
+	waitTimers(t, clock, 0)
+	if n := s.Len(); n != 0 {
+		t.Fatalf("pending:%d", n)
+	}
+}
+
+func TestSchedulerFixedDelay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	pool := NewRoutinePool(2)
+	defer pool.StopWait()
+	s := NewScheduler(pool, WithSchedulerClock(clock))
+	defer s.Stop()
+
+	var (
+		ran     = make(chan string, 10)
+		release = make(chan struct{})
+	)
+	st := s.RunEvery(time.Second, TaskFunc(func() {
+		ran <- "tick"
+		<-release
+	}), WithFixedDelay())
+
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	expectRun(t, ran, "tick")
+
+	// nothing is scheduled while the run is in progress
+	waitTimers(t, clock, 0)
+	clock.Advance(5 * time.Second)
+	expectIdle(t, ran)
+
+	release <- struct{}{}
+	waitTimers(t, clock, 1)
+	clock.Advance(999 * time.Millisecond)
+	expectIdle(t, ran)
+	clock.Advance(time.Millisecond)
+	expectRun(t, ran, "tick")
+
+	st.Cancel()
+	release <- struct{}{}
+	waitTimers(t, clock, 0)
+	if n := s.Len(); n != 0 {
+		t.Fatalf("pending:%d", n)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	pool := NewRoutinePool(2)
+	defer pool.StopWait()
+	s := NewScheduler(pool)
+
+	ran := make(chan string, 100)
+	begin := time.Now()
+	s.RunEvery(5*time.Millisecond, sendTask(ran, "tick"), WithJitter(5*time.Millisecond))
+	for i := 0; i < 3; i++ {
+		expectRun(t, ran, "tick")
+	}
+	s.Stop()
+	if cost := time.Now().Sub(begin); cost < 15*time.Millisecond {
+		t.Fatalf("3 runs in %s", cost)
+	} else {
+		t.Logf("3 runs in %s", cost)
+	}
+}
+
+func TestSchedulerJitterNoDrift(t *testing.T) {
+	begin := time.Unix(0, 0)
+	clock := NewFakeClock(begin)
+	pool := NewRoutinePool(2)
+	defer pool.StopWait()
+	s := NewScheduler(pool, WithSchedulerClock(clock))
+	defer s.Stop()
+
+	ran := make(chan string, 10)
+	st := s.RunEvery(time.Second, sendTask(ran, "tick"), WithJitter(900*time.Millisecond))
+	for i := 1; i <= 50; i++ {
+		waitTimers(t, clock, 1)
+		s.mu.Lock()
+		at := st.at
+		s.mu.Unlock()
+		// every run is jittered off its own slot, never off the last run
+		slot := begin.Add(time.Duration(i) * time.Second)
+		if at.Before(slot) || !at.Before(slot.Add(900*time.Millisecond)) {
+			t.Fatalf("run %d at %s", i, at.Sub(begin))
+		}
+		clock.Advance(at.Sub(clock.Now()))
+		expectRun(t, ran, "tick")
+	}
+}
+
+func TestSchedulerSkipMissed(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	pool := NewRoutinePool(2)
+	defer pool.StopWait()
+	s := NewScheduler(pool, WithSchedulerClock(clock))
+	defer s.Stop()
+
+	ran := make(chan string, 10)
+	s.RunEvery(time.Second, sendTask(ran, "tick"))
+	waitTimers(t, clock, 1)
+	clock.Advance(10*time.Second + 500*time.Millisecond)
+	expectRun(t, ran, "tick")
+	expectIdle(t, ran)
+
+	// the next slot is at 11s
+	waitTimers(t, clock, 1)
+	clock.Advance(499 * time.Millisecond)
+	expectIdle(t, ran)
+	clock.Advance(time.Millisecond)
+	expectRun(t, ran, "tick")
+}
+
+func TestSchedulerRejected(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	block, running := make(chan struct{}), make(chan struct{})
+	pool := NewRoutinePool(1, WithQueueSize(0))
+	pool.Run(TaskFunc(func() {
+		close(running)
+		<-block
+	}))
+	<-running
+
+	rejected := make(chan error, 10)
+	s := NewScheduler(pool, WithSchedulerClock(clock), WithRejectHandler(func(st *ScheduledTask, err error) {
+		rejected <- err
+	}))
+	defer s.Stop()
+
+	ran := make(chan string, 10)
+	s.RunAfter(time.Second, sendTask(ran, "once"))
+	s.RunEvery(time.Second, sendTask(ran, "delay"), WithFixedDelay())
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-rejected:
+			if err != ErrPoolFull {
+				t.Fatalf("rejected, err:%v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("run %d neither ran nor was rejected", i)
+		}
+	}
+
+	// the refused fixed delay task is scheduled again
+	waitTimers(t, clock, 1)
+	close(block)
+	for s.pool.Stats().Active > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	expectRun(t, ran, "delay")
+	pool.StopWait()
+}
@@ -0,0 +1,203 @@
+package mutex
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"rock/base"
+	"rock/log"
+)
+
+// LockDetector is an opt-in debugging aid. Locks wrapped by it record which
+// locks every goroutine holds, every nested acquisition adds an edge to a lock
+// order graph, and an edge closing a cycle is reported as a potential deadlock.
+// Locks held longer than the hold threshold are reported when released.
+type LockDetector struct {
+	mu            sync.Mutex
+	log           *log.LogAdaptor
+	holdThreshold time.Duration
+	held          map[int][]heldLock                 // goroutine id => locks in acquisition order
+	graph         map[*DebugLock]map[*DebugLock]bool // lock => locks acquired while holding it
+	cycles        [][]string
+}
+
+type heldLock struct {
+	l  *DebugLock
+	at time.Time
+}
+
+// NewLockDetector reports through l, or the std log when l is nil. A zero
+// holdThreshold disables hold time reports.
+func NewLockDetector(l *log.LogAdaptor, holdThreshold time.Duration) *LockDetector {
+	if l == nil {
+		l = log.NewLogAdaptor(nil)
+	}
+	return &LockDetector{
+		log:           l,
+		holdThreshold: holdThreshold,
+		held:          make(map[int][]heldLock),
+		graph:         make(map[*DebugLock]map[*DebugLock]bool),
+	}
+}
+
+// Wrap returns a lock that behaves like l and is tracked under name.
+func (d *LockDetector) Wrap(name string, l sync.Locker) *DebugLock {
+	return &DebugLock{
+		Locker: l,
+		name:   name,
+		d:      d,
+	}
+}
+
+// Cycles returns the lock names of every potential deadlock reported so far,
+// each cycle starts and ends with the same lock.
+func (d *LockDetector) Cycles() [][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cycles := make([][]string, len(d.cycles))
+	copy(cycles, d.cycles)
+	return cycles
+}
+
+func (d *LockDetector) acquire(gid int, l *DebugLock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	held := d.held[gid]
+	reentrant := false
+	for _, h := range held {
+		if h.l == l {
+			reentrant = true
+			break
+		}
+	}
+	if !reentrant {
+		for _, h := range held {
+			d.addEdge(h.l, l)
+		}
+	}
+	d.held[gid] = append(held, heldLock{l: l})
+}
+
+func (d *LockDetector) acquired(gid int, l *DebugLock) {
+	d.mu.Lock()
+	if i := lastHeld(d.held[gid], l, false); i >= 0 {
+		d.held[gid][i].at = time.Now()
+	}
+	d.mu.Unlock()
+}
+
+// release forgets l in the goroutine holding it, which is not always gid:
+// like sync.Mutex, a lock may be unlocked by another goroutine than the one
+// that locked it.
+func (d *LockDetector) release(gid int, l *DebugLock) {
+	d.mu.Lock()
+	owner, i := gid, lastHeld(d.held[gid], l, false)
+	if i < 0 {
+		owner, i = d.owner(l)
+	}
+	if i < 0 {
+		d.mu.Unlock()
+		d.log.Errorf("lock %s released by goroutine %d but not held", l.name, gid)
+		return
+	}
+	held := d.held[owner]
+	at := held[i].at
+	held = append(held[:i], held[i+1:]...)
+	if len(held) == 0 {
+		delete(d.held, owner)
+	} else {
+		d.held[owner] = held
+	}
+	d.mu.Unlock()
+
+	if cost := time.Now().Sub(at); d.holdThreshold > 0 && cost > d.holdThreshold {
+		d.log.Errorf("lock %s held by goroutine %d for %s, threshold %s", l.name, owner, cost, d.holdThreshold)
+	}
+}
+
+// owner returns the goroutine that acquired l and its index in its held
+// locks, -1 if nobody did. It must be called with mu held.
+func (d *LockDetector) owner(l *DebugLock) (gid, i int) {
+	for gid, held := range d.held {
+		if i := lastHeld(held, l, true); i >= 0 {
+			return gid, i
+		}
+	}
+	return -1, -1
+}
+
+// lastHeld returns the index of the last entry of l in held, -1 if none.
+// Waiting entries, not acquired yet, are skipped when acquired is set.
+func lastHeld(held []heldLock, l *DebugLock, acquired bool) int {
+	for i := len(held) - 1; i >= 0; i-- {
+		if held[i].l == l && (!acquired || !held[i].at.IsZero()) {
+			return i
+		}
+	}
+	return -1
+}
+
+// addEdge records that to was acquired while holding from, it must be called with mu held
+func (d *LockDetector) addEdge(from, to *DebugLock) {
+	if d.graph[from][to] {
+		return
+	}
+	if d.graph[from] == nil {
+		d.graph[from] = make(map[*DebugLock]bool)
+	}
+	d.graph[from][to] = true
+
+	path := d.path(to, from, make(map[*DebugLock]bool))
+	if path == nil {
+		return
+	}
+	names := make([]string, 0, len(path)+1)
+	for _, l := range path {
+		names = append(names, l.name)
+	}
+	names = append(names, to.name)
+	d.cycles = append(d.cycles, names)
+	d.log.Errorf("potential deadlock, lock order cycle: %s", strings.Join(names, " -> "))
+}
+
+// path returns the locks from "from" to "to" along the graph, nil if unreachable
+func (d *LockDetector) path(from, to *DebugLock, visited map[*DebugLock]bool) []*DebugLock {
+	if from == to {
+		return []*DebugLock{to}
+	}
+	visited[from] = true
+	for next := range d.graph[from] {
+		if visited[next] {
+			continue
+		}
+		if p := d.path(next, to, visited); p != nil {
+			return append([]*DebugLock{from}, p...)
+		}
+	}
+	return nil
+}
+
+// DebugLock is a lock tracked by a LockDetector.
+type DebugLock struct {
+	sync.Locker
+	name string
+	d    *LockDetector
+}
+
+func (dl *DebugLock) Name() string {
+	return dl.name
+}
+
+func (dl *DebugLock) Lock() {
+	gid := base.GoID()
+	dl.d.acquire(gid, dl)
+	dl.Locker.Lock()
+	dl.d.acquired(gid, dl)
+}
+
+func (dl *DebugLock) Unlock() {
+	dl.d.release(base.GoID(), dl)
+	dl.Locker.Unlock()
+}
@@ -0,0 +1,120 @@
+package mutex
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rock/log"
+)
+
+type recordLog struct {
+	sync.Mutex
+	errors []string
+}
+
+func (r *recordLog) Debug(v ...interface{})                 {}
+func (r *recordLog) Debugf(format string, v ...interface{}) {}
+func (r *recordLog) Info(v ...interface{})                  {}
+func (r *recordLog) Infof(format string, v ...interface{})  {}
+func (r *recordLog) Error(v ...interface{}) {
+	r.Errorf("%s", fmt.Sprint(v...))
+}
+func (r *recordLog) Errorf(format string, v ...interface{}) {
+	r.Lock()
+	r.errors = append(r.errors, fmt.Sprintf(format, v...))
+	r.Unlock()
+}
+
+func TestLockDetectorCycle(t *testing.T) {
+	rl := &recordLog{}
+	d := NewLockDetector(log.NewLogAdaptor(rl), 0)
+	a := d.Wrap("a", &sync.Mutex{})
+	b := d.Wrap("b", NewRecursiveLock(NewSpinLock(true)))
+	c := d.Wrap("c", NewSpinLock(true))
+
+	a.Lock()
+	b.Lock()
+	b.Lock()
+	c.Lock()
+	c.Unlock()
+	b.Unlock()
+	b.Unlock()
+	a.Unlock()
+	if cycles := d.Cycles(); len(cycles) != 0 {
+		t.Fatalf("unexpected cycles:%v", cycles)
+	}
+
+	// reverse order in another goroutine, never actually deadlocks
+	done := make(chan struct{})
+	go func() {
+		c.Lock()
+		a.Lock()
+		a.Unlock()
+		c.Unlock()
+		close(done)
+	}()
+	<-done
+
+	cycles := d.Cycles()
+	if len(cycles) != 1 || strings.Join(cycles[0], ",") != "a,b,c,a" && strings.Join(cycles[0], ",") != "a,c,a" {
+		t.Fatalf("cycles:%v", cycles)
+	}
+	if len(rl.errors) != 1 || !strings.Contains(rl.errors[0], "potential deadlock") {
+		t.Fatalf("errors:%v", rl.errors)
+	}
+	t.Log(rl.errors[0])
+}
+
+func TestLockDetectorHoldTime(t *testing.T) {
+	rl := &recordLog{}
+	d := NewLockDetector(log.NewLogAdaptor(rl), 5*time.Millisecond)
+	l := d.Wrap("slow", &sync.Mutex{})
+
+	l.Lock()
+	l.Unlock()
+	l.Lock()
+	time.Sleep(10 * time.Millisecond)
+	l.Unlock()
+	if len(rl.errors) != 1 || !strings.Contains(rl.errors[0], "lock slow held") {
+		t.Fatalf("errors:%v", rl.errors)
+	}
+	t.Log(rl.errors[0])
+}
+
+func TestLockDetectorForeignUnlock(t *testing.T) {
+	rl := &recordLog{}
+	d := NewLockDetector(log.NewLogAdaptor(rl), 0)
+	a := d.Wrap("a", &sync.Mutex{})
+	b := d.Wrap("b", &sync.Mutex{})
+
+	// locked here, unlocked by another goroutine as sync.Mutex allows
+	a.Lock()
+	done := make(chan struct{})
+	go func() {
+		a.Unlock()
+		close(done)
+	}()
+	<-done
+
+	// a is no longer held here, locking b must not record a -> b
+	b.Lock()
+	b.Unlock()
+	done = make(chan struct{})
+	go func() {
+		b.Lock()
+		a.Lock()
+		a.Unlock()
+		b.Unlock()
+		close(done)
+	}()
+	<-done
+	if cycles := d.Cycles(); len(cycles) != 0 {
+		t.Fatalf("unexpected cycles:%v", cycles)
+	}
+	if len(rl.errors) != 0 {
+		t.Fatalf("errors:%v", rl.errors)
+	}
+}
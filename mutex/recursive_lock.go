@@ -1,19 +1,82 @@
 package mutex
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"rock/base"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// TryLocker is implemented by locks that can be acquired without waiting,
+// such as SpinLock. RecursiveLock polls TryLock to time out on inner locks
+// without LockTimeout or LockContext.
+type TryLocker interface {
+	sync.Locker
+	TryLock() bool
+}
+
+// TimeoutLocker is implemented by locks that can give up after a duration.
+type TimeoutLocker interface {
+	sync.Locker
+	LockTimeout(d time.Duration) bool
+}
+
+// ContextLocker is implemented by locks that can give up when a context is done.
+type ContextLocker interface {
+	sync.Locker
+	LockContext(ctx context.Context) error
+}
+
+var (
+	ErrLockUnreachable = errors.New("lock unreachable")
+	ErrUnlockNotOwner  = errors.New("lock before unlock")
+)
+
+// OwnershipError is the panic value of a misused RecursiveLock.
+type OwnershipError struct {
+	Err       error // ErrLockUnreachable or ErrUnlockNotOwner
+	Owner     int64 // owner goroutine id, -1 when unlocked
+	Current   int64 // goroutine id of the caller
+	HoldCount int
+	Stack     []byte // owner's acquisition stack, only captured WithAcquireStack
+}
+
+func (e *OwnershipError) Error() string {
+	msg := fmt.Sprintf("%s, owner:%d current:%d hold count:%d", e.Err, e.Owner, e.Current, e.HoldCount)
+	if len(e.Stack) > 0 {
+		msg += "\nacquired at:\n" + string(e.Stack)
+	}
+	return msg
+}
+
+func (e *OwnershipError) Unwrap() error {
+	return e.Err
+}
+
 type RecursiveLock struct {
 	sync.Locker
-	gid int64
-	cnt int
+	gid       int64
+	cnt       int64
+	withStack bool
+	stack     atomic.Value // []byte
+}
+
+type recursiveLockOption func(*RecursiveLock)
+
+// WithAcquireStack captures the owner's stack on every first acquisition so
+// that ownership errors can tell where the lock was taken, it is costly.
+func WithAcquireStack() recursiveLockOption {
+	return func(rl *RecursiveLock) {
+		rl.withStack = true
+	}
 }
 
-func NewRecursiveLock(l sync.Locker) *RecursiveLock {
+func NewRecursiveLock(l sync.Locker, options ...recursiveLockOption) *RecursiveLock {
 	r := &RecursiveLock{
 		Locker: l,
 		gid:    -1,
@@ -21,28 +84,137 @@ func NewRecursiveLock(l sync.Locker) *RecursiveLock {
 	if reflect.TypeOf(r).String() == reflect.TypeOf(l).String() {
 		panic("cannot use recursive lock as inner lock")
 	}
+	for _, option := range options {
+		option(r)
+	}
 	return r
 }
 
+// Owner returns the goroutine id holding the lock, -1 when it is unlocked.
+func (rl *RecursiveLock) Owner() int64 {
+	return atomic.LoadInt64(&rl.gid)
+}
+
+// HoldCount returns how many times the owner has acquired the lock.
+func (rl *RecursiveLock) HoldCount() int {
+	return int(atomic.LoadInt64(&rl.cnt))
+}
+
+func (rl *RecursiveLock) ownershipError(err error, gid int64) *OwnershipError {
+	e := &OwnershipError{
+		Err:       err,
+		Owner:     atomic.LoadInt64(&rl.gid),
+		Current:   gid,
+		HoldCount: rl.HoldCount(),
+	}
+	if rl.withStack && e.Owner != -1 {
+		e.Stack, _ = rl.stack.Load().([]byte)
+	}
+	return e
+}
+
 func (rl *RecursiveLock) Lock() {
 	gid := (int64)(base.GoID())
-	if rl.gid != gid {
+	if atomic.LoadInt64(&rl.gid) != gid {
 		rl.Locker.Lock()
-		if !atomic.CompareAndSwapInt64(&rl.gid, -1, gid) {
-			panic("lock unreachable")
+		rl.own(gid)
+	}
+	atomic.AddInt64(&rl.cnt, 1)
+}
+
+func (rl *RecursiveLock) own(gid int64) {
+	if !atomic.CompareAndSwapInt64(&rl.gid, -1, gid) {
+		panic(rl.ownershipError(ErrLockUnreachable, gid))
+	}
+	if rl.withStack {
+		buf := make([]byte, 4096)
+		rl.stack.Store(buf[:runtime.Stack(buf, false)])
+	}
+}
+
+// TryLock acquires the lock if the current goroutine already holds it or the
+// inner lock can be taken without waiting. The inner lock must be a TryLocker.
+func (rl *RecursiveLock) TryLock() bool {
+	gid := (int64)(base.GoID())
+	if atomic.LoadInt64(&rl.gid) != gid {
+		tl, ok := rl.Locker.(TryLocker)
+		if !ok {
+			panic("inner lock does not support TryLock")
+		}
+		if !tl.TryLock() {
+			return false
+		}
+		rl.own(gid)
+	}
+	atomic.AddInt64(&rl.cnt, 1)
+	return true
+}
+
+// LockTimeout waits at most d for the lock, reports whether it was acquired.
+// The inner lock must be a TimeoutLocker or a TryLocker.
+func (rl *RecursiveLock) LockTimeout(d time.Duration) bool {
+	gid := (int64)(base.GoID())
+	if atomic.LoadInt64(&rl.gid) != gid {
+		var locked bool
+		if tl, ok := rl.Locker.(TimeoutLocker); ok {
+			locked = tl.LockTimeout(d)
+		} else {
+			deadline := time.Now().Add(d)
+			locked = rl.pollLock(func() bool {
+				return !time.Now().Before(deadline)
+			})
+		}
+		if !locked {
+			return false
+		}
+		rl.own(gid)
+	}
+	atomic.AddInt64(&rl.cnt, 1)
+	return true
+}
+
+// LockContext waits for the lock until ctx is done, returns ctx.Err() if it gave up.
+// The inner lock must be a ContextLocker or a TryLocker.
+func (rl *RecursiveLock) LockContext(ctx context.Context) error {
+	gid := (int64)(base.GoID())
+	if atomic.LoadInt64(&rl.gid) != gid {
+		if cl, ok := rl.Locker.(ContextLocker); ok {
+			if err := cl.LockContext(ctx); err != nil {
+				return err
+			}
+		} else if !rl.pollLock(func() bool {
+			return ctx.Err() != nil
+		}) {
+			return ctx.Err()
+		}
+		rl.own(gid)
+	}
+	atomic.AddInt64(&rl.cnt, 1)
+	return nil
+}
+
+// pollLock retries TryLock on the inner lock until it succeeds or is cancelled
+func (rl *RecursiveLock) pollLock(cancelled func() bool) bool {
+	tl, ok := rl.Locker.(TryLocker)
+	if !ok {
+		panic("inner lock does not support TryLock")
+	}
+	for !tl.TryLock() {
+		if cancelled() {
+			return false
 		}
+		runtime.Gosched()
 	}
-	rl.cnt++
+	return true
 }
 
 func (rl *RecursiveLock) Unlock() {
 	gid := (int64)(base.GoID())
-	if rl.gid != gid {
-		panic("lock before unlock")
+	if atomic.LoadInt64(&rl.gid) != gid {
+		panic(rl.ownershipError(ErrUnlockNotOwner, gid))
 	}
 
-	rl.cnt--
-	if rl.cnt == 0 {
+	if atomic.AddInt64(&rl.cnt, -1) == 0 {
 		atomic.CompareAndSwapInt64(&rl.gid, gid, -1)
 		rl.Locker.Unlock()
 	}
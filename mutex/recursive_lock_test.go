@@ -1,6 +1,10 @@
 package mutex
 
 import (
+	"context"
+	"errors"
+	"rock/base"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,6 +21,7 @@ func doRecursiveLock(l *RecursiveLock) {
 }
 
 func TestRecursiveLock(t *testing.T) {
+	count = 0
 	//mx := NewRecursiveLock(&sync.Mutex{})
 	mx := NewSpinLock(true)
 	//mx := &sync.Mutex{}
@@ -40,3 +45,95 @@ func TestRecursiveLock(t *testing.T) {
 		t.Logf("count:%d loop:%d, cost:%s", count, loop, time.Now().Sub(begin))
 	}
 }
+
+// tryOnlyLock hides the timed methods of SpinLock, so RecursiveLock has to
+// poll TryLock
+type tryOnlyLock struct {
+	l *SpinLock
+}
+
+func (tl tryOnlyLock) Lock()         { tl.l.Lock() }
+func (tl tryOnlyLock) Unlock()       { tl.l.Unlock() }
+func (tl tryOnlyLock) TryLock() bool { return tl.l.TryLock() }
+
+func TestRecursiveLockTimeout(t *testing.T) {
+	for _, inner := range []sync.Locker{NewSpinLock(true), tryOnlyLock{NewSpinLock(true)}} {
+		l := NewRecursiveLock(inner)
+		if !l.TryLock() || !l.LockTimeout(time.Millisecond) || l.LockContext(context.Background()) != nil {
+			t.Fatalf("%T reentrant lock failed", inner)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if l.TryLock() {
+				t.Errorf("%T trylock held lock", inner)
+			}
+			if l.LockTimeout(5 * time.Millisecond) {
+				t.Errorf("%T lock timeout acquired held lock", inner)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer cancel()
+			if err := l.LockContext(ctx); err != context.DeadlineExceeded {
+				t.Errorf("%T lock context, err:%v", inner, err)
+			}
+		}()
+		<-done
+
+		l.Unlock()
+		l.Unlock()
+		l.Unlock()
+
+		done = make(chan struct{})
+		go func() {
+			defer close(done)
+			if !l.LockTimeout(time.Second) {
+				t.Errorf("%T lock timeout on free lock", inner)
+				return
+			}
+			l.Unlock()
+		}()
+		<-done
+	}
+}
+
+func TestRecursiveLockOwnership(t *testing.T) {
+	l := NewRecursiveLock(&sync.Mutex{}, WithAcquireStack())
+	if l.Owner() != -1 || l.HoldCount() != 0 {
+		t.Fatalf("owner:%d hold count:%d", l.Owner(), l.HoldCount())
+	}
+
+	l.Lock()
+	l.Lock()
+	if l.Owner() != int64(base.GoID()) || l.HoldCount() != 2 {
+		t.Fatalf("owner:%d hold count:%d", l.Owner(), l.HoldCount())
+	}
+
+	var err *OwnershipError
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			err, _ = recover().(*OwnershipError)
+		}()
+		l.Unlock()
+	}()
+	<-done
+
+	if err == nil || !errors.Is(err, ErrUnlockNotOwner) {
+		t.Fatalf("err:%v", err)
+	}
+	if err.Owner != l.Owner() || err.Current == err.Owner || err.HoldCount != 2 {
+		t.Fatalf("err:%+v", err)
+	}
+	if !strings.Contains(string(err.Stack), "TestRecursiveLockOwnership") {
+		t.Fatalf("stack:%s", err.Stack)
+	}
+	t.Log(err)
+
+	l.Unlock()
+	l.Unlock()
+	if l.Owner() != -1 || l.HoldCount() != 0 {
+		t.Fatalf("owner:%d hold count:%d", l.Owner(), l.HoldCount())
+	}
+}
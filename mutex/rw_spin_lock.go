@@ -0,0 +1,82 @@
+package mutex
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// RWSpinLock is a reader/writer spin lock. A waiting writer stops new readers
+// from entering, so a steady stream of readers cannot starve writers.
+type RWSpinLock struct {
+	writer      int32 // 1 when a writer holds or waits for the lock
+	readers     int32
+	enableSched bool
+}
+
+func NewRWSpinLock(enableSched bool) *RWSpinLock {
+	return &RWSpinLock{
+		enableSched: enableSched,
+	}
+}
+
+func (s *RWSpinLock) spin() {
+	if s.enableSched {
+		runtime.Gosched()
+	}
+}
+
+func (s *RWSpinLock) RLock() {
+	for {
+		for atomic.LoadInt32(&s.writer) != 0 {
+			s.spin()
+		}
+		atomic.AddInt32(&s.readers, 1)
+		if atomic.LoadInt32(&s.writer) == 0 {
+			return
+		}
+		// a writer came in between, give way to it
+		atomic.AddInt32(&s.readers, -1)
+	}
+}
+
+// RUnlock panics without a matching RLock, readers never goes below zero so
+// a recovered panic does not wedge the writers.
+func (s *RWSpinLock) RUnlock() {
+	for {
+		readers := atomic.LoadInt32(&s.readers)
+		if readers <= 0 {
+			panic("runlock of unlocked rwspinlock")
+		}
+		if atomic.CompareAndSwapInt32(&s.readers, readers, readers-1) {
+			return
+		}
+	}
+}
+
+func (s *RWSpinLock) Lock() {
+	for !atomic.CompareAndSwapInt32(&s.writer, 0, 1) {
+		s.spin()
+	}
+	for atomic.LoadInt32(&s.readers) != 0 {
+		s.spin()
+	}
+}
+
+func (s *RWSpinLock) Unlock() {
+	if !atomic.CompareAndSwapInt32(&s.writer, 1, 0) {
+		panic("unlock of unlocked rwspinlock")
+	}
+}
+
+// RLocker returns a sync.Locker that calls RLock and RUnlock.
+func (s *RWSpinLock) RLocker() sync.Locker {
+	return rlocker{s}
+}
+
+type rlocker struct {
+	s *RWSpinLock
+}
+
+func (r rlocker) Lock()   { r.s.RLock() }
+func (r rlocker) Unlock() { r.s.RUnlock() }
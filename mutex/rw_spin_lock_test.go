@@ -0,0 +1,119 @@
+package mutex
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var rwCount int64
+
+func doRWSpinLock(l *RWSpinLock, t *testing.T) {
+	l.RLock()
+	// writers keep count even while holding the lock
+	if c := atomic.LoadInt64(&rwCount); c%2 != 0 {
+		t.Errorf("read while writing, count:%d", c)
+	}
+	l.RUnlock()
+
+	l.Lock()
+	atomic.AddInt64(&rwCount, 1)
+	atomic.AddInt64(&rwCount, 1)
+	l.Unlock()
+}
+
+func TestRWSpinLock(t *testing.T) {
+	for _, sched := range []bool{false, true} {
+		rwCount = 0
+		l := NewRWSpinLock(sched)
+		var (
+			wg    sync.WaitGroup
+			begin = time.Now()
+		)
+		wg.Add(loop)
+		for i := 0; i < loop; i++ {
+			go func() {
+				doRWSpinLock(l, t)
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		if rwCount != int64(2*loop) {
+			t.Fatalf("sched:%v count:%d loop:%d", sched, rwCount, loop)
+		} else {
+			t.Logf("sched:%v count:%d loop:%d, cost:%s", sched, rwCount, loop, time.Now().Sub(begin))
+		}
+	}
+}
+
+func TestRWSpinLockWriterPreference(t *testing.T) {
+	l := NewRWSpinLock(true)
+	l.RLock()
+
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+		l.Unlock()
+	}()
+
+	// wait for the writer to announce itself
+	for atomic.LoadInt32(&l.writer) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rlocked := make(chan struct{})
+	go func() {
+		l.RLock()
+		close(rlocked)
+		l.RUnlock()
+	}()
+
+	select {
+	case <-rlocked:
+		t.Fatalf("reader entered before waiting writer")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.RUnlock()
+	<-locked
+	<-rlocked
+}
+
+func TestRWSpinLockUnmatchedRUnlock(t *testing.T) {
+	l := NewRWSpinLock(true)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("unmatched runlock did not panic")
+			}
+		}()
+		l.RUnlock()
+	}()
+	if l.readers != 0 {
+		t.Fatalf("readers:%d", l.readers)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		l.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("writer wedged after unmatched runlock")
+	}
+}
+
+func BenchmarkRWSpinLockRead(b *testing.B) {
+	l := NewRWSpinLock(true)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.RLock()
+			l.RUnlock()
+		}
+	})
+}
@@ -1 +1,108 @@
 package mutex
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// SeqLock is a sequence lock for read-mostly data. Writers are serialized by
+// the inner locker and bump the sequence around every modification, readers
+// never block writers, they just retry when the sequence moved:
+//
+//	for {
+//		seq := sl.ReadBegin()
+//		// read the protected data
+//		if !sl.ReadRetry(seq) {
+//			break
+//		}
+//	}
+//
+// Readers may observe a torn value inside the loop, so the data should only be
+// copied there and be used after ReadRetry returns false. Both sides must
+// access the fields with sync/atomic, a plain copy races with the writers
+// under the Go memory model even when the retry discards it. SeqValue is
+// simpler for data that is replaced as a whole.
+type SeqLock struct {
+	sync.Locker
+	seq uint64
+}
+
+func NewSeqLock(l sync.Locker) *SeqLock {
+	if l == nil {
+		l = &sync.Mutex{}
+	}
+	return &SeqLock{
+		Locker: l,
+	}
+}
+
+func (sl *SeqLock) Lock() {
+	sl.Locker.Lock()
+	// odd sequence means write in progress
+	atomic.AddUint64(&sl.seq, 1)
+}
+
+func (sl *SeqLock) Unlock() {
+	atomic.AddUint64(&sl.seq, 1)
+	sl.Locker.Unlock()
+}
+
+// ReadBegin waits until no writer is in progress and returns the sequence
+// that must be passed to ReadRetry.
+func (sl *SeqLock) ReadBegin() uint64 {
+	for {
+		seq := atomic.LoadUint64(&sl.seq)
+		if seq&1 == 0 {
+			return seq
+		}
+		runtime.Gosched()
+	}
+}
+
+// ReadRetry reports whether a writer has run since ReadBegin returned seq,
+// in which case the read has to be done again.
+func (sl *SeqLock) ReadRetry(seq uint64) bool {
+	return atomic.LoadUint64(&sl.seq) != seq
+}
+
+// Sequence returns the current sequence, it is even when no writer holds the lock.
+func (sl *SeqLock) Sequence() uint64 {
+	return atomic.LoadUint64(&sl.seq)
+}
+
+// SeqValue keeps a value loaded without locking and replaced under a writer
+// lock. The value is boxed in an atomic.Value, so Load always returns a whole
+// value some writer stored, of any type, and never blocks.
+type SeqValue struct {
+	mu sync.Mutex   // serializes Store and Update
+	v  atomic.Value // seqBox
+}
+
+// seqBox gives atomic.Value the one concrete type it requires
+type seqBox struct {
+	v interface{}
+}
+
+func NewSeqValue(v interface{}) *SeqValue {
+	sv := &SeqValue{}
+	sv.v.Store(seqBox{v})
+	return sv
+}
+
+func (sv *SeqValue) Load() interface{} {
+	return sv.v.Load().(seqBox).v
+}
+
+func (sv *SeqValue) Store(v interface{}) {
+	sv.mu.Lock()
+	sv.v.Store(seqBox{v})
+	sv.mu.Unlock()
+}
+
+// Update calls f with the current value under the writer lock and stores the result.
+func (sv *SeqValue) Update(f func(interface{}) interface{}) {
+	sv.mu.Lock()
+	sv.v.Store(seqBox{f(sv.Load())})
+	sv.mu.Unlock()
+}
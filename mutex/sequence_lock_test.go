@@ -0,0 +1,206 @@
+package mutex
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// pair is written as a whole by writers, a reader must never see a != b
+type pair struct {
+	a int64
+	b int64
+}
+
+func readPair(sl *SeqLock, p *pair) (a, b int64, retries int) {
+	for {
+		seq := sl.ReadBegin()
+		a = atomic.LoadInt64(&p.a)
+		b = atomic.LoadInt64(&p.b)
+		if !sl.ReadRetry(seq) {
+			return
+		}
+		retries++
+	}
+}
+
+func TestSeqLock(t *testing.T) {
+	var (
+		sl      = NewSeqLock(NewSpinLock(true))
+		p       pair
+		wg      sync.WaitGroup
+		stop    int32
+		retries int64
+	)
+
+	wg.Add(loop)
+	for i := 0; i < loop; i++ {
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				a, b, r := readPair(sl, &p)
+				if a != b {
+					t.Errorf("torn read, a:%d b:%d", a, b)
+					return
+				}
+				atomic.AddInt64(&retries, int64(r))
+			}
+		}()
+	}
+
+	for i := 0; i < 10000; i++ {
+		sl.Lock()
+		atomic.AddInt64(&p.a, 1)
+		atomic.AddInt64(&p.b, 1)
+		sl.Unlock()
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if a, b, _ := readPair(sl, &p); a != 10000 || b != 10000 {
+		t.Fatalf("a:%d b:%d", a, b)
+	}
+	if seq := sl.Sequence(); seq != 20000 {
+		t.Fatalf("sequence:%d", seq)
+	}
+	t.Logf("reader retries:%d", retries)
+}
+
+func TestSeqLockRetry(t *testing.T) {
+	sl := NewSeqLock(nil)
+	seq := sl.ReadBegin()
+	if sl.ReadRetry(seq) {
+		t.Fatalf("retry without writer")
+	}
+	sl.Lock()
+	sl.Unlock()
+	if !sl.ReadRetry(seq) {
+		t.Fatalf("no retry after writer")
+	}
+}
+
+func TestSeqValue(t *testing.T) {
+	sv := NewSeqValue(pair{})
+	var wg sync.WaitGroup
+
+	wg.Add(loop)
+	for i := 0; i < loop; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p := sv.Load().(pair)
+				if p.a != p.b {
+					t.Errorf("torn read, a:%d b:%d", p.a, p.b)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		sv.Update(func(v interface{}) interface{} {
+			p := v.(pair)
+			p.a++
+			p.b++
+			return p
+		})
+	}
+	wg.Wait()
+
+	if p := sv.Load().(pair); p.a != 1000 || p.b != 1000 {
+		t.Fatalf("a:%d b:%d", p.a, p.b)
+	}
+}
+
+// evenPair and oddPair have the same layout but different checks, a torn
+// Load pairing the type of one with the data of the other fails the check
+type evenPair struct {
+	n     uint64
+	check uint64 // n*2
+}
+
+type oddPair struct {
+	n     uint64
+	check uint64 // ^n
+}
+
+func checkPair(v interface{}) bool {
+	switch p := v.(type) {
+	case evenPair:
+		return p.check == p.n*2
+	case oddPair:
+		return p.check == ^p.n
+	case nil:
+		return true
+	}
+	return false
+}
+
+func TestSeqValueTypes(t *testing.T) {
+	var (
+		sv   = NewSeqValue(nil)
+		wg   sync.WaitGroup
+		stop int32
+	)
+	wg.Add(loop)
+	for i := 0; i < loop; i++ {
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				if v := sv.Load(); !checkPair(v) {
+					t.Errorf("torn read:%#v", v)
+					return
+				}
+			}
+		}()
+	}
+
+	for n := uint64(1); n <= 10000; n++ {
+		switch n % 3 {
+		case 0:
+			sv.Store(evenPair{n: n, check: n * 2})
+		case 1:
+			sv.Store(oddPair{n: n, check: ^n})
+		default:
+			sv.Store(nil)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	if p, ok := sv.Load().(oddPair); !ok || p.n != 10000 {
+		t.Fatalf("last value:%#v", sv.Load())
+	}
+}
+
+func BenchmarkSeqLockRead(b *testing.B) {
+	sl := NewSeqLock(nil)
+	var p pair
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			readPair(sl, &p)
+		}
+	})
+}
+
+func BenchmarkRWMutexRead(b *testing.B) {
+	var (
+		l sync.RWMutex
+		p pair
+	)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.RLock()
+			_, _ = p.a, p.b
+			l.RUnlock()
+		}
+	})
+}
+
+func BenchmarkSeqValueLoad(b *testing.B) {
+	sv := NewSeqValue(pair{})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sv.Load()
+		}
+	})
+}
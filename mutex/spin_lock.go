@@ -1,31 +1,233 @@
 package mutex
 
 import (
+	"context"
 	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
+)
+
+type spinStrategy uint8
+
+const (
+	pureSpin spinStrategy = iota
+	expBackoffSpin
+	yieldSpin
+	sleepSpin
+	parkSpin
 )
 
 type SpinLock struct {
-	next        int64
-	owner       int64
-	enableSched bool
+	next      int64
+	owner     int64
+	strategy  spinStrategy
+	limit     int      // spin rounds before yield/sleep/park, max pause for backoff
+	abandon   int64    // number of abandoned tickets not yet skipped
+	abandoned sync.Map // ticket => struct{}
+	parked    sync.Map // ticket => chan struct{}, closed when ticket owns the lock
+}
+
+type spinLockOption func(*SpinLock)
+
+// WithPureSpin busy-spins without ever giving up the processor.
+func WithPureSpin() spinLockOption {
+	return func(s *SpinLock) {
+		s.strategy = pureSpin
+	}
+}
+
+// WithExpBackoff spins with a busy wait that doubles every round up to max iterations.
+func WithExpBackoff(max int) spinLockOption {
+	return func(s *SpinLock) {
+		if max <= 0 {
+			panic("max backoff must be positive")
+		}
+		s.strategy, s.limit = expBackoffSpin, max
+	}
+}
+
+// WithSpinYield spins n rounds, then calls runtime.Gosched every round.
+func WithSpinYield(n int) spinLockOption {
+	return func(s *SpinLock) {
+		if n < 0 {
+			panic("spin rounds cannot be negative")
+		}
+		s.strategy, s.limit = yieldSpin, n
+	}
 }
 
-func NewSpinLock(enableSched bool) *SpinLock {
-	return &SpinLock{
-		enableSched: enableSched,
+// WithSpinSleep spins n rounds, then the next ticket holder calls
+// runtime.Gosched every round while the waiters behind it sleep a
+// microsecond per ticket ahead of them, so with many waiters the next holder
+// is not queued behind all of them.
+func WithSpinSleep(n int) spinLockOption {
+	return func(s *SpinLock) {
+		if n < 0 {
+			panic("spin rounds cannot be negative")
+		}
+		s.strategy, s.limit = sleepSpin, n
 	}
 }
 
+// WithSpinPark spins n rounds, then parks until its ticket is served, an
+// Unlock wakes only the next ticket holder.
+func WithSpinPark(n int) spinLockOption {
+	return func(s *SpinLock) {
+		if n < 0 {
+			panic("spin rounds cannot be negative")
+		}
+		s.strategy, s.limit = parkSpin, n
+	}
+}
+
+// NewSpinLock yields the processor on every round when enableSched is set and
+// busy-spins otherwise, options choose another strategy.
+func NewSpinLock(enableSched bool, options ...spinLockOption) *SpinLock {
+	s := &SpinLock{}
+	if enableSched {
+		s.strategy = yieldSpin
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
 func (s *SpinLock) Lock() {
-	n := atomic.AddInt64(&s.next, 1)
-	for (n - 1) != s.owner {
-		if s.enableSched {
+	ticket := atomic.AddInt64(&s.next, 1) - 1
+	for i := 0; ticket != atomic.LoadInt64(&s.owner); i++ {
+		if s.strategy == parkSpin && i >= s.limit {
+			s.park(ticket)
+			return
+		}
+		s.pause(ticket, i)
+	}
+}
+
+// pause backs off after the i-th failed round of ticket, it never parks
+func (s *SpinLock) pause(ticket int64, i int) {
+	switch s.strategy {
+	case expBackoffSpin:
+		n := s.limit
+		if i < 32 && 1<<uint(i) < n {
+			n = 1 << uint(i)
+		}
+		spinWait(n)
+	case yieldSpin, parkSpin:
+		if i >= s.limit {
+			runtime.Gosched()
+		}
+	case sleepSpin:
+		if i < s.limit {
+			return
+		}
+		// Gosched puts us at the back of the run queue, so with every waiter
+		// yielding the next holder waits for all of them to run first. The
+		// ones further back sleep off the run queue instead.
+		if ahead := ticket - atomic.LoadInt64(&s.owner); ahead > 1 {
+			time.Sleep(time.Duration(ahead) * time.Microsecond)
+		} else {
 			runtime.Gosched()
 		}
 	}
 }
 
+// park blocks until ticket owns the lock. Either park sees the owner after
+// registering or the unlocker sees the registration, so no wakeup is lost.
+func (s *SpinLock) park(ticket int64) {
+	ch := make(chan struct{})
+	s.parked.Store(ticket, ch)
+	if ticket == atomic.LoadInt64(&s.owner) {
+		if _, ok := s.parked.LoadAndDelete(ticket); ok {
+			return
+		}
+	}
+	<-ch
+}
+
+// wake wakes the parked holder of the current owner ticket, if any
+func (s *SpinLock) wake() {
+	if s.strategy != parkSpin {
+		return
+	}
+	if ch, ok := s.parked.LoadAndDelete(atomic.LoadInt64(&s.owner)); ok {
+		close(ch.(chan struct{}))
+	}
+}
+
+// spinWait is a busy loop of n iterations, not a cpu pause instruction, it
+// only keeps the waiter off the lock word for a while.
+//
+//go:noinline
+func spinWait(n int) {
+	for i := 0; i < n; i++ {
+	}
+}
+
 func (s *SpinLock) Unlock() {
-	atomic.AddInt64(&s.owner, 1)
+	ticket := atomic.AddInt64(&s.owner, 1)
+	s.skip(ticket)
+	s.wake()
+}
+
+// skip passes the lock over abandoned tickets starting at ticket
+func (s *SpinLock) skip(ticket int64) {
+	for atomic.LoadInt64(&s.abandon) > 0 {
+		if _, ok := s.abandoned.LoadAndDelete(ticket); !ok {
+			return
+		}
+		atomic.AddInt64(&s.abandon, -1)
+		ticket = atomic.AddInt64(&s.owner, 1)
+	}
+}
+
+// TryLock acquires the lock only if it is free and nobody is waiting for it.
+func (s *SpinLock) TryLock() bool {
+	owner := atomic.LoadInt64(&s.owner)
+	return atomic.CompareAndSwapInt64(&s.next, owner, owner+1)
+}
+
+// LockTimeout waits at most d for the lock, reports whether it was acquired.
+func (s *SpinLock) LockTimeout(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	return s.lockUntil(func() bool {
+		return !time.Now().Before(deadline)
+	})
+}
+
+// LockContext waits for the lock until ctx is done, returns ctx.Err() if it gave up.
+func (s *SpinLock) LockContext(ctx context.Context) error {
+	if s.lockUntil(func() bool {
+		return ctx.Err() != nil
+	}) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+func (s *SpinLock) lockUntil(cancelled func() bool) bool {
+	ticket := atomic.AddInt64(&s.next, 1) - 1
+	for i := 0; ticket != atomic.LoadInt64(&s.owner); i++ {
+		if cancelled() {
+			s.abandonTicket(ticket)
+			return false
+		}
+		s.pause(ticket, i)
+	}
+	return true
+}
+
+// abandonTicket leaves ticket to whoever reaches it first: the unlocker that
+// moves owner onto it, or ourselves if owner already got there.
+func (s *SpinLock) abandonTicket(ticket int64) {
+	atomic.AddInt64(&s.abandon, 1)
+	s.abandoned.Store(ticket, struct{}{})
+	if atomic.LoadInt64(&s.owner) != ticket {
+		return
+	}
+	if _, ok := s.abandoned.LoadAndDelete(ticket); ok {
+		atomic.AddInt64(&s.abandon, -1)
+		s.Unlock()
+	}
 }
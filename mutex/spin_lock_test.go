@@ -1,7 +1,11 @@
 package mutex
 
 import (
+	"context"
+	"fmt"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,6 +22,7 @@ func doSpinLock(l *SpinLock) {
 }
 
 func TestSpinLock(t *testing.T) {
+	count = 0
 	l := NewSpinLock(false)
 	var (
 		wg    sync.WaitGroup
@@ -55,3 +60,181 @@ func TestSpinLock(t *testing.T) {
 		t.Logf("count:%d loop:%d, cost:%s", count, loop, time.Now().Sub(begin))
 	}
 }
+
+func TestSpinLockTryLock(t *testing.T) {
+	l := NewSpinLock(true)
+	if !l.TryLock() {
+		t.Fatalf("trylock free lock")
+	}
+	if l.TryLock() {
+		t.Fatalf("trylock held lock")
+	}
+	l.Unlock()
+	if !l.TryLock() {
+		t.Fatalf("trylock after unlock")
+	}
+	l.Unlock()
+}
+
+func TestSpinLockTimeout(t *testing.T) {
+	l := NewSpinLock(true)
+	l.Lock()
+
+	begin := time.Now()
+	if l.LockTimeout(10 * time.Millisecond) {
+		t.Fatalf("lock timeout acquired held lock")
+	}
+	if cost := time.Now().Sub(begin); cost < 10*time.Millisecond {
+		t.Fatalf("lock timeout returned early, cost:%s", cost)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.LockContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("lock context, err:%v", err)
+	}
+
+	// the abandoned tickets must not wedge later waiters
+	l.Unlock()
+	if !l.LockTimeout(time.Second) {
+		t.Fatalf("lock wedged by abandoned tickets")
+	}
+	l.Unlock()
+	if !l.TryLock() {
+		t.Fatalf("trylock after abandoned tickets")
+	}
+	l.Unlock()
+}
+
+func TestSpinLockAbandonConcurrent(t *testing.T) {
+	count = 0
+	l := NewSpinLock(true)
+	var (
+		wg     sync.WaitGroup
+		locked int64
+	)
+	wg.Add(loop)
+	for i := 0; i < loop; i++ {
+		go func(no int) {
+			defer wg.Done()
+			if no%2 == 0 {
+				l.Lock()
+			} else if !l.LockTimeout(time.Duration(no) * time.Microsecond) {
+				return
+			}
+			count++
+			atomic.AddInt64(&locked, 1)
+			l.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	if int64(count) != locked {
+		t.Fatalf("count:%d locked:%d", count, locked)
+	}
+	if !l.TryLock() {
+		t.Fatalf("lock wedged, next:%d owner:%d", l.next, l.owner)
+	}
+}
+
+func TestSpinLockStrategy(t *testing.T) {
+	const (
+		rounds  = 50
+		timeout = 10 * time.Second
+	)
+	// the spinning strategies never give up their processor, with more
+	// waiters than processors the next ticket holder may wait for preemption
+	procs := runtime.GOMAXPROCS(0)
+	for _, c := range []struct {
+		name       string
+		l          *SpinLock
+		goroutines int
+	}{
+		{"pure", NewSpinLock(false, WithPureSpin()), procs},
+		{"backoff", NewSpinLock(false, WithExpBackoff(64)), procs},
+		{"yield", NewSpinLock(false, WithSpinYield(16)), 32},
+		{"sleep", NewSpinLock(false, WithSpinSleep(16)), 32},
+		{"park", NewSpinLock(false, WithSpinPark(16)), 32},
+	} {
+		var (
+			n     int // guarded by c.l, the goroutines of a timed out case may still run
+			wg    sync.WaitGroup
+			done  = make(chan struct{})
+			begin = time.Now()
+		)
+		wg.Add(c.goroutines)
+		for i := 0; i < c.goroutines; i++ {
+			go func(l *SpinLock) {
+				for j := 0; j < rounds; j++ {
+					l.Lock()
+					n++
+					l.Unlock()
+				}
+				wg.Done()
+			}(c.l)
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			t.Fatalf("%s not done in %s, next:%d owner:%d", c.name, timeout, atomic.LoadInt64(&c.l.next), atomic.LoadInt64(&c.l.owner))
+		}
+		if n != c.goroutines*rounds {
+			t.Fatalf("%s count:%d expect:%d", c.name, n, c.goroutines*rounds)
+		}
+		t.Logf("%s count:%d, cost:%s", c.name, n, time.Since(begin))
+	}
+}
+
+func benchLocker(b *testing.B, newLocker func() sync.Locker) {
+	procsList := []int{1}
+	if runtime.NumCPU() > 1 {
+		procsList = append(procsList, runtime.NumCPU())
+	}
+	for _, procs := range procsList {
+		for _, goroutines := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("procs-%d/goroutines-%d", procs, goroutines), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				var (
+					l  = newLocker()
+					wg sync.WaitGroup
+					n  = b.N/goroutines + 1
+				)
+				b.ResetTimer()
+				wg.Add(goroutines)
+				for i := 0; i < goroutines; i++ {
+					go func() {
+						for j := 0; j < n; j++ {
+							l.Lock()
+							l.Unlock()
+						}
+						wg.Done()
+					}()
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+func BenchmarkMutex(b *testing.B) {
+	benchLocker(b, func() sync.Locker { return &sync.Mutex{} })
+}
+
+func BenchmarkSpinLockPure(b *testing.B) {
+	benchLocker(b, func() sync.Locker { return NewSpinLock(false, WithPureSpin()) })
+}
+
+func BenchmarkSpinLockExpBackoff(b *testing.B) {
+	benchLocker(b, func() sync.Locker { return NewSpinLock(false, WithExpBackoff(128)) })
+}
+
+func BenchmarkSpinLockYield(b *testing.B) {
+	benchLocker(b, func() sync.Locker { return NewSpinLock(false, WithSpinYield(32)) })
+}
+
+func BenchmarkSpinLockPark(b *testing.B) {
+	benchLocker(b, func() sync.Locker { return NewSpinLock(false, WithSpinPark(32)) })
+}